@@ -4,19 +4,34 @@ package letsdane
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"math/big"
 	"net"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/miekg/dns"
 )
 
+// minCertValidity is the lower bound of the validity period
+// of generated certificates when capped by a short TLSA TTL.
+const minCertValidity = time.Minute
+
+// certBackdate is subtracted from the issue time of generated
+// certificates to tolerate clock skew between client and proxy.
+const certBackdate = 5 * time.Minute
+
 // maxSerialNumber is the upper boundary that is used to create unique serial
 // numbers for the certificate. This can be any unsigned integer up to 20
 // bytes (2^(8*20)-1).
@@ -25,17 +40,63 @@ var maxSerialNumber = big.NewInt(0).SetBytes(bytes.Repeat([]byte{255}, 20))
 // mitmConfig is a set of configuration values that are used to build TLS configs
 // capable of MITM.
 type mitmConfig struct {
-	ca             *x509.Certificate
-	capriv         interface{}
+	ca             *authority
 	priv           *rsa.PrivateKey
 	keyID          []byte
 	validity       time.Duration
 	org            string
 	getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
-	roots          *x509.CertPool
+
+	// next optionally replaces ca as the issuer
+	// once switchover is reached.
+	next       *authority
+	switchover time.Time
+
+	// inventory of issued certificates used to build
+	// CRLs served under crlURL (if set)
+	inventory *inventory
+	crlURL    string
 
 	certmu sync.RWMutex
-	certs  map[string]*tls.Certificate
+	certs  map[string]*cachedCert
+
+	// listenCerts are the certificates of the proxy listener
+	// kept apart from certs so that they aren't superseded
+	// by certificates for intercepted hosts of the same name.
+	listenCerts map[string]*tls.Certificate
+}
+
+// cachedCert is a generated certificate bound to
+// the TLSA RRset that justified it.
+type cachedCert struct {
+	*tls.Certificate
+	rrset   string
+	expires time.Time
+}
+
+// authority is a CA certificate and the private key
+// used to sign generated certificates.
+type authority struct {
+	cert  *x509.Certificate
+	priv  crypto.Signer
+	roots *x509.CertPool
+
+	// id is the hex encoded SHA-1 hash of the CA public key
+	id string
+}
+
+func newAuthority(ca *x509.Certificate, privateKey crypto.Signer) *authority {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	h := sha1.Sum(ca.RawSubjectPublicKeyInfo)
+
+	return &authority{
+		cert:  ca,
+		priv:  privateKey,
+		roots: roots,
+		id:    hex.EncodeToString(h[:]),
+	}
 }
 
 // NewAuthority creates a new CA certificate and associated
@@ -45,13 +106,68 @@ func NewAuthority(name, organization string, validity time.Duration, constraints
 	if err != nil {
 		return nil, nil, err
 	}
-	pub := priv.Public()
 
+	x509c, err := NewAuthorityWithSigner(name, organization, validity, constraints, priv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return x509c, priv, nil
+}
+
+// NewAuthorityWithSigner creates a new CA certificate for an
+// existing private key such as one stored in a hardware token.
+func NewAuthorityWithSigner(name, organization string, validity time.Duration, constraints map[string]struct{}, priv crypto.Signer) (*x509.Certificate, error) {
+	tmpl, err := authorityTemplate(name, organization, validity, priv.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	if constraints != nil {
+		tmpl.PermittedDNSDomainsCritical = true
+		tmpl.ExcludedIPRanges = allIPRanges()
+
+		var names []string
+		for name := range constraints {
+			names = append(names, "."+name)
+		}
+
+		tmpl.ExcludedDNSDomains = names
+	}
+
+	return selfSign(tmpl, priv)
+}
+
+// NewPermittedAuthority creates a new CA certificate that
+// can only issue certificates for names within the permitted zones.
+func NewPermittedAuthority(name, organization string, validity time.Duration, permitted map[string]struct{}, priv crypto.Signer) (*x509.Certificate, error) {
+	if len(permitted) == 0 {
+		return nil, errors.New("no permitted zones")
+	}
+
+	tmpl, err := authorityTemplate(name, organization, validity, priv.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl.PermittedDNSDomainsCritical = true
+	tmpl.ExcludedIPRanges = allIPRanges()
+	for zone := range permitted {
+		tmpl.PermittedDNSDomains = append(tmpl.PermittedDNSDomains, zone)
+	}
+	sort.Strings(tmpl.PermittedDNSDomains)
+
+	return selfSign(tmpl, priv)
+}
+
+// authorityTemplate returns the certificate template of a CA
+// without name constraints
+func authorityTemplate(name, organization string, validity time.Duration, pub crypto.PublicKey) (*x509.Certificate, error) {
 	// Subject Key Identifier support for end entity certificate.
 	// https://www.ietf.org/rfc/rfc3280.txt (section 4.2.1.2)
 	pkixpub, err := x509.MarshalPKIXPublicKey(pub)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	h := sha1.New()
 	h.Write(pkixpub)
@@ -61,17 +177,17 @@ func NewAuthority(name, organization string, validity time.Duration, constraints
 	// serial multiple times.
 	serial, err := rand.Int(rand.Reader, maxSerialNumber)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	tmpl := &x509.Certificate{
+	return &x509.Certificate{
 		SerialNumber: serial,
 		Subject: pkix.Name{
 			CommonName:   name,
 			Organization: []string{organization},
 		},
 		SubjectKeyId:          keyID,
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
 		NotBefore:             time.Now().Add(-validity),
@@ -79,42 +195,35 @@ func NewAuthority(name, organization string, validity time.Duration, constraints
 		DNSNames:              []string{name},
 		IsCA:                  true,
 		MaxPathLenZero:        true,
-	}
-
-	if constraints != nil {
-		tmpl.PermittedDNSDomainsCritical = true
-		_, ipv4, _ := net.ParseCIDR("0.0.0.0/0")
-		_, ipv6, _ := net.ParseCIDR("::/0")
-		tmpl.ExcludedIPRanges = []*net.IPNet{ipv4, ipv6}
-
-		var names []string
-		for name := range constraints {
-			names = append(names, "."+name)
-		}
+	}, nil
+}
 
-		tmpl.ExcludedDNSDomains = names
-	}
+// allIPRanges returns the IPv4 and IPv6 ranges covering all addresses
+func allIPRanges() []*net.IPNet {
+	_, ipv4, _ := net.ParseCIDR("0.0.0.0/0")
+	_, ipv6, _ := net.ParseCIDR("::/0")
+	return []*net.IPNet{ipv4, ipv6}
+}
 
-	raw, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, priv)
+// selfSign creates a self-signed certificate from tmpl
+func selfSign(tmpl *x509.Certificate, priv crypto.Signer) (*x509.Certificate, error) {
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, priv.Public(), priv)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	// Parse certificate bytes so that we have a leaf certificate.
 	x509c, err := x509.ParseCertificate(raw)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	return x509c, priv, nil
+	return x509c, nil
 }
 
 // newMITMConfig creates a MITM config using the CA certificate and
 // private key to generate on-the-fly certificates.
-func newMITMConfig(ca *x509.Certificate, privateKey interface{}, validity time.Duration, organization string) (*mitmConfig, error) {
-	roots := x509.NewCertPool()
-	roots.AddCert(ca)
-
+func newMITMConfig(ca *x509.Certificate, privateKey crypto.Signer, validity time.Duration, organization string) (*mitmConfig, error) {
 	priv, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
 		return nil, err
@@ -132,58 +241,171 @@ func newMITMConfig(ca *x509.Certificate, privateKey interface{}, validity time.D
 	keyID := h.Sum(nil)
 
 	return &mitmConfig{
-		ca:       ca,
-		capriv:   privateKey,
+		ca:       newAuthority(ca, privateKey),
 		priv:     priv,
 		keyID:    keyID,
 		validity: validity,
 		org:      organization,
-		certs:    make(map[string]*tls.Certificate),
-		roots:    roots,
+		certs:    make(map[string]*cachedCert),
+
+		listenCerts: make(map[string]*tls.Certificate),
 	}, nil
 }
 
+// setSuccessor configures a CA that takes over issuing
+// certificates at the given switchover time.
+func (c *mitmConfig) setSuccessor(ca *x509.Certificate, privateKey crypto.Signer, switchover time.Time) {
+	c.next = newAuthority(ca, privateKey)
+	c.switchover = switchover
+}
+
+// enableCRL embeds a CRL distribution point in issued certificates
+// and keeps track of them in inv so that they can be revoked.
+func (c *mitmConfig) enableCRL(url string, inv *inventory) error {
+	for _, a := range []*authority{c.ca, c.next} {
+		if a != nil && a.cert.KeyUsage&x509.KeyUsageCRLSign == 0 {
+			return fmt.Errorf("CA %s cannot sign CRLs (missing crlSign key usage), rotate the CA to enable CRLs", a.cert.Subject)
+		}
+	}
+
+	c.crlURL = url
+	c.inventory = inv
+	return nil
+}
+
+// issuer returns the authority used to sign new certificates.
+func (c *mitmConfig) issuer() *authority {
+	if c.next != nil && !time.Now().Before(c.switchover) {
+		return c.next
+	}
+	return c.ca
+}
+
 // configForTLSADomain returns a *tls.mitmConfig that will generate certificates on-the-fly
-// using the provided hostname
-func (c *mitmConfig) configForTLSADomain(tlsaDomain string) *tls.Config {
+// using the provided hostname. Certificates are bound to the given TLSA records.
+// Clients that don't send SNI are served a certificate for the hostname.
+func (c *mitmConfig) configForTLSADomain(tlsaDomain string, tlsa []*dns.TLSA) *tls.Config {
 	return &tls.Config{
 		GetCertificate: func(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-			if tlsaDomain != clientHello.ServerName {
+			if clientHello.ServerName != "" && tlsaDomain != clientHello.ServerName {
 				return nil, fmt.Errorf("tlsa domain `%s` does not match server name `%s`", tlsaDomain, clientHello.ServerName)
 			}
-			return c.cert(tlsaDomain)
+			return c.cert(tlsaDomain, tlsa)
 		},
 	}
 }
 
-func (c *mitmConfig) cert(hostname string) (*tls.Certificate, error) {
+// cert returns a certificate for hostname. A cached certificate
+// is only reused while the TLSA records are unchanged and their
+// TTL has not expired. The validity of new certificates is capped
+// at the TLSA TTL.
+func (c *mitmConfig) cert(hostname string, tlsa []*dns.TLSA) (*tls.Certificate, error) {
 	// Remove the port if it exists.
 	host, _, err := net.SplitHostPort(hostname)
 	if err == nil {
 		hostname = host
 	}
 
+	issuer := c.issuer()
+	rrset, ttl := tlsaKey(tlsa)
+	now := time.Now()
+
 	c.certmu.RLock()
-	tlsc, ok := c.certs[hostname]
+	cached, ok := c.certs[hostname]
 	c.certmu.RUnlock()
 
-	if ok {
+	if ok && cached.rrset == rrset && (cached.expires.IsZero() || now.Before(cached.expires)) {
 		// Check validity of the certificate for hostname match, expiry, etc. In
-		// particular, if the cached certificate has expired, create a new one.
-		if _, err := tlsc.Leaf.Verify(x509.VerifyOptions{
+		// particular, if the cached certificate has expired or was signed by
+		// a CA that is no longer the issuer, create a new one.
+		if _, err := cached.Leaf.Verify(x509.VerifyOptions{
 			DNSName: hostname,
-			Roots:   c.roots,
+			Roots:   issuer.roots,
+		}); err == nil {
+			return cached.Certificate, nil
+		}
+	}
+
+	if ok && cached.rrset != rrset {
+		// the records that justified the previous certificate changed
+		if _, err := c.revoke(hostname, reasonSuperseded); err != nil {
+			return nil, err
+		}
+	}
+
+	validity := c.validity
+	var expires time.Time
+	if ttl >= 0 {
+		if ttl < minCertValidity {
+			ttl = minCertValidity
+		}
+		expires = now.Add(ttl)
+		if ttl < validity {
+			validity = ttl
+		}
+	}
+
+	tlsc, err := c.newCert(issuer, hostname, validity)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.inventory != nil {
+		if err := c.inventory.add(tlsc.Leaf, hostname, issuer.id); err != nil {
+			return nil, err
+		}
+	}
+
+	c.certmu.Lock()
+	c.certs[hostname] = &cachedCert{
+		Certificate: tlsc,
+		rrset:       rrset,
+		expires:     expires,
+	}
+	c.certmu.Unlock()
+
+	return tlsc, nil
+}
+
+// listenCert returns the certificate served by
+// the proxy listener for one of its names.
+func (c *mitmConfig) listenCert(name string) (*tls.Certificate, error) {
+	issuer := c.issuer()
+
+	c.certmu.RLock()
+	cached, ok := c.listenCerts[name]
+	c.certmu.RUnlock()
+
+	if ok {
+		if _, err := cached.Leaf.Verify(x509.VerifyOptions{
+			DNSName: name,
+			Roots:   issuer.roots,
 		}); err == nil {
-			return tlsc, nil
+			return cached, nil
 		}
+	}
 
+	tlsc, err := c.newCert(issuer, name, c.validity)
+	if err != nil {
+		return nil, err
 	}
 
+	c.certmu.Lock()
+	c.listenCerts[name] = tlsc
+	c.certmu.Unlock()
+
+	return tlsc, nil
+}
+
+// newCert creates a certificate for hostname signed by
+// the issuer that is valid for the given duration.
+func (c *mitmConfig) newCert(issuer *authority, hostname string, validity time.Duration) (*tls.Certificate, error) {
 	serial, err := rand.Int(rand.Reader, maxSerialNumber)
 	if err != nil {
 		return nil, err
 	}
 
+	now := time.Now()
 	tmpl := &x509.Certificate{SerialNumber: serial,
 		Subject: pkix.Name{
 			CommonName:   hostname,
@@ -193,9 +415,8 @@ func (c *mitmConfig) cert(hostname string) (*tls.Certificate, error) {
 		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
-		NotBefore: time.
-			Now().Add(-c.validity),
-		NotAfter: time.Now().Add(c.validity),
+		NotBefore:             now.Add(-certBackdate),
+		NotAfter:              now.Add(validity),
 	}
 
 	if ip := net.ParseIP(hostname); ip != nil {
@@ -204,7 +425,11 @@ func (c *mitmConfig) cert(hostname string) (*tls.Certificate, error) {
 		tmpl.DNSNames = []string{hostname}
 	}
 
-	raw, err := x509.CreateCertificate(rand.Reader, tmpl, c.ca, c.priv.Public(), c.capriv)
+	if c.crlURL != "" {
+		tmpl.CRLDistributionPoints = []string{crlURL(c.crlURL, issuer)}
+	}
+
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, issuer.cert, c.priv.Public(), issuer.priv)
 	if err != nil {
 		return nil, err
 	}
@@ -215,15 +440,31 @@ func (c *mitmConfig) cert(hostname string) (*tls.Certificate, error) {
 		return nil, err
 	}
 
-	tlsc = &tls.Certificate{
-		Certificate: [][]byte{raw, c.ca.Raw},
+	return &tls.Certificate{
+		Certificate: [][]byte{raw, issuer.cert.Raw},
 		PrivateKey:  c.priv,
 		Leaf:        x509c,
+	}, nil
+}
+
+// tlsaKey returns a canonical representation of the TLSA RRset
+// ignoring TTLs and the minimum TTL of the set.
+// ttl is negative if there are no records.
+func tlsaKey(rrs []*dns.TLSA) (key string, ttl time.Duration) {
+	if len(rrs) == 0 {
+		return "", -1
 	}
 
-	c.certmu.Lock()
-	c.certs[hostname] = tlsc
-	c.certmu.Unlock()
+	ttl = time.Duration(rrs[0].Hdr.Ttl) * time.Second
+	records := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		if t := time.Duration(rr.Hdr.Ttl) * time.Second; t < ttl {
+			ttl = t
+		}
+		records = append(records, fmt.Sprintf("%d %d %d %s",
+			rr.Usage, rr.Selector, rr.MatchingType, strings.ToLower(rr.Certificate)))
+	}
+	sort.Strings(records)
 
-	return tlsc, nil
+	return strings.Join(records, "\n"), ttl
 }
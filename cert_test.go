@@ -3,6 +3,8 @@ package letsdane
 // based on github.com/google/martian/mitm
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"net"
@@ -45,6 +47,47 @@ func TestConstraints(t *testing.T) {
 	}
 }
 
+func TestPermittedAuthority(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := NewPermittedAuthority("DNSSEC", "DNSSEC", 24*time.Hour, map[string]struct{}{"3b": {}}, priv)
+	if err != nil {
+		t.Fatalf("NewPermittedAuthority(): got %v, want no error", err)
+	}
+	if !ca.PermittedDNSDomainsCritical {
+		t.Error("ca.PermittedDNSDomainsCritical: got false, want true")
+	}
+
+	c, err := newMITMConfig(ca, priv, time.Hour, "DNSSEC")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	for name, valid := range map[string]bool{"3b": true, "foo.3b": true, "example.com": false} {
+		tlsc, err := c.cert(name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = tlsc.Leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots})
+		if valid && err != nil {
+			t.Errorf("%s: got %v, want no error", name, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("%s: got no error, want name constraint error", name)
+		}
+	}
+
+	if _, err := NewPermittedAuthority("DNSSEC", "DNSSEC", time.Hour, nil, priv); err == nil {
+		t.Error("NewPermittedAuthority(nil): got no error")
+	}
+}
+
 func TestMITM(t *testing.T) {
 	ca, priv, err := NewAuthority("DNSSEC", "DNSSEC", 24*time.Hour, nil)
 	if err != nil {
@@ -56,7 +99,7 @@ func TestMITM(t *testing.T) {
 		t.Fatalf("NewConfig(): got %v, want no error", err)
 	}
 
-	conf := c.configForTLSADomain("example.com")
+	conf := c.configForTLSADomain("example.com", nil)
 
 	if conf.InsecureSkipVerify {
 		t.Error("conf.InsecureSkipVerify: got true, want false")
@@ -67,14 +110,19 @@ func TestMITM(t *testing.T) {
 		ServerName: "",
 	}
 
-	if _, err := conf.GetCertificate(clientHello); err == nil {
-		t.Fatal("conf.GetCertificate(): got nil, want error")
+	// The tlsa domain is used if the client doesn't send SNI
+	tlsc, err := conf.GetCertificate(clientHello)
+	if err != nil {
+		t.Fatalf("conf.GetCertificate(): got %v, want no error", err)
+	}
+	if got, want := tlsc.Leaf.Subject.CommonName, "example.com"; got != want {
+		t.Errorf("x509c.Subject.CommonName: got %q, want %q", got, want)
 	}
 
 	// Simulate a TLS connection with SNI.
 	clientHello.ServerName = "example.com"
 
-	tlsc, err := conf.GetCertificate(clientHello)
+	tlsc, err = conf.GetCertificate(clientHello)
 	if err != nil {
 		t.Fatalf("conf.GetCertificate(): got %v, want no error", err)
 	}
@@ -90,13 +138,6 @@ func TestMITM(t *testing.T) {
 	if err == nil {
 		t.Fatalf("conf.GetCertificate(): got nil, want error")
 	}
-
-	// ServerName cannot be empty
-	clientHello.ServerName = ""
-	tlsc, err = conf.GetCertificate(clientHello)
-	if err == nil {
-		t.Fatalf("conf.GetCertificate(): got nil, want error")
-	}
 }
 
 func TestCert(t *testing.T) {
@@ -110,7 +151,7 @@ func TestCert(t *testing.T) {
 		t.Fatalf("NewConfig(): got %v, want no error", err)
 	}
 
-	tlsc, err := c.cert("example.com")
+	tlsc, err := c.cert("example.com", nil)
 	if err != nil {
 		t.Fatalf("c.cert(%q): got %v, want no error", "example.com:8080", err)
 	}
@@ -175,7 +216,7 @@ func TestCert(t *testing.T) {
 	}
 
 	// Retrieve cached certificate.
-	tlsc2, err := c.cert("example.com")
+	tlsc2, err := c.cert("example.com", nil)
 	if err != nil {
 		t.Fatalf("c.cert(%q): got %v, want no error", "example.com", err)
 	}
@@ -184,7 +225,7 @@ func TestCert(t *testing.T) {
 	}
 
 	// TLS certificate for IP.
-	tlsc, err = c.cert("10.0.0.1:8227")
+	tlsc, err = c.cert("10.0.0.1:8227", nil)
 	if err != nil {
 		t.Fatalf("c.cert(%q): got %v, want no error", "10.0.0.1:8227", err)
 	}
@@ -198,3 +239,124 @@ func TestCert(t *testing.T) {
 		t.Fatalf("x509c.IPAddresses: got %v, want %v", got, want)
 	}
 }
+
+func TestCertSuccessor(t *testing.T) {
+	ca, priv, err := NewAuthority("DNSSEC", "DNSSEC", 24*time.Hour, nil)
+	if err != nil {
+		t.Fatalf("NewAuthority(): got %v, want no error", err)
+	}
+	next, nextPriv, err := NewAuthority("DNSSEC", "DNSSEC", 24*time.Hour, nil)
+	if err != nil {
+		t.Fatalf("NewAuthority(): got %v, want no error", err)
+	}
+
+	c, err := newMITMConfig(ca, priv, time.Hour, "DNSSEC")
+	if err != nil {
+		t.Fatalf("NewConfig(): got %v, want no error", err)
+	}
+
+	// successor must not be used before switchover
+	c.setSuccessor(next, nextPriv, time.Now().Add(time.Hour))
+	tlsc, err := c.cert("example.com", nil)
+	if err != nil {
+		t.Fatalf("c.cert(%q): got %v, want no error", "example.com", err)
+	}
+	if err := tlsc.Leaf.CheckSignatureFrom(ca); err != nil {
+		t.Errorf("tlsc.Leaf.CheckSignatureFrom(ca): got %v, want no error", err)
+	}
+
+	// cached certificate from the previous CA must be replaced
+	c.switchover = time.Now().Add(-time.Minute)
+	tlsc2, err := c.cert("example.com", nil)
+	if err != nil {
+		t.Fatalf("c.cert(%q): got %v, want no error", "example.com", err)
+	}
+	if tlsc == tlsc2 {
+		t.Fatal("tlsc2: got cached certificate, want new certificate")
+	}
+	if err := tlsc2.Leaf.CheckSignatureFrom(next); err != nil {
+		t.Errorf("tlsc2.Leaf.CheckSignatureFrom(next): got %v, want no error", err)
+	}
+	if got, want := tlsc2.Certificate[1], next.Raw; !reflect.DeepEqual(got, want) {
+		t.Error("tlsc2.Certificate[1]: got previous CA, want successor in chain")
+	}
+}
+
+func TestCertTLSA(t *testing.T) {
+	ca, priv, err := NewAuthority("DNSSEC", "DNSSEC", 24*time.Hour, nil)
+	if err != nil {
+		t.Fatalf("NewAuthority(): got %v, want no error", err)
+	}
+
+	c, err := newMITMConfig(ca, priv, time.Hour, "DNSSEC")
+	if err != nil {
+		t.Fatalf("NewConfig(): got %v, want no error", err)
+	}
+
+	tlsa := newTLSA(3, 1, 1, ca)
+	tlsa[0].Hdr.Ttl = 300
+
+	tlsc, err := c.cert("example.com", tlsa)
+	if err != nil {
+		t.Fatalf("c.cert(%q): got %v, want no error", "example.com", err)
+	}
+	if max := time.Now().Add(300 * time.Second); tlsc.Leaf.NotAfter.After(max) {
+		t.Errorf("tlsc.Leaf.NotAfter: got %v, want before %v", tlsc.Leaf.NotAfter, max)
+	}
+
+	// same records with a different ttl
+	same := newTLSA(3, 1, 1, ca)
+	same[0].Hdr.Ttl = 200
+	tlsc2, err := c.cert("example.com", same)
+	if err != nil {
+		t.Fatalf("c.cert(%q): got %v, want no error", "example.com", err)
+	}
+	if tlsc != tlsc2 {
+		t.Error("tlsc2: got new certificate, want cached certificate")
+	}
+
+	// TLSA TTL expired
+	c.certs["example.com"].expires = time.Now().Add(-time.Second)
+	tlsc3, err := c.cert("example.com", same)
+	if err != nil {
+		t.Fatalf("c.cert(%q): got %v, want no error", "example.com", err)
+	}
+	if tlsc3 == tlsc2 {
+		t.Error("tlsc3: got cached certificate, want new certificate")
+	}
+
+	// changed records with a short ttl
+	changed := newTLSA(3, 0, 1, ca)
+	changed[0].Hdr.Ttl = 5
+	tlsc4, err := c.cert("example.com", changed)
+	if err != nil {
+		t.Fatalf("c.cert(%q): got %v, want no error", "example.com", err)
+	}
+	if tlsc4 == tlsc3 {
+		t.Error("tlsc4: got cached certificate, want new certificate")
+	}
+	if min := time.Now().Add(minCertValidity - time.Second); tlsc4.Leaf.NotAfter.Before(min) {
+		t.Errorf("tlsc4.Leaf.NotAfter: got %v, want after %v", tlsc4.Leaf.NotAfter, min)
+	}
+	if max := time.Now().Add(minCertValidity); tlsc4.Leaf.NotAfter.After(max) {
+		t.Errorf("tlsc4.Leaf.NotAfter: got %v, want before %v", tlsc4.Leaf.NotAfter, max)
+	}
+	if min := time.Now().Add(-certBackdate - time.Second); tlsc4.Leaf.NotBefore.Before(min) {
+		t.Errorf("tlsc4.Leaf.NotBefore: got %v, want after %v", tlsc4.Leaf.NotBefore, min)
+	}
+
+	// a ttl of 0 is cached for minCertValidity
+	zero := newTLSA(3, 1, 1, ca)
+	zero[0].Hdr.Ttl = 0
+	tlsc5, err := c.cert("example.com", zero)
+	if err != nil {
+		t.Fatalf("c.cert(%q): got %v, want no error", "example.com", err)
+	}
+	tlsc6, err := c.cert("example.com", zero)
+	if err != nil {
+		t.Fatalf("c.cert(%q): got %v, want no error", "example.com", err)
+	}
+	if tlsc6 != tlsc5 {
+		t.Error("tlsc6: got new certificate, want cached certificate")
+	}
+}
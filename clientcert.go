@@ -0,0 +1,103 @@
+package letsdane
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// ClientIdentity is a client certificate presented on the
+// upstream leg to destinations requesting one.
+type ClientIdentity struct {
+	// Hosts lists destinations (domains or *.domain wildcards
+	// optionally followed by :port) the identity is used for.
+	Hosts       []string
+	Certificate tls.Certificate
+
+	// Browser optionally maps the identity to a browser client
+	// certificate given as its hex encoded SHA-256 fingerprint.
+	// The identity is then only presented if the browser presented
+	// that certificate. Requires RequestClientCerts.
+	Browser string
+}
+
+type clientIdentity struct {
+	hosts   *hostPortSet
+	cert    *tls.Certificate
+	browser string
+}
+
+func newClientIdentities(ids []*ClientIdentity) ([]*clientIdentity, error) {
+	var identities []*clientIdentity
+	for _, id := range ids {
+		if len(id.Hosts) == 0 {
+			return nil, fmt.Errorf("client identity has no hosts")
+		}
+		if len(id.Certificate.Certificate) == 0 {
+			return nil, fmt.Errorf("client identity for %s has no certificate", id.Hosts[0])
+		}
+
+		hosts, err := newHostPortSet(id.Hosts)
+		if err != nil {
+			return nil, err
+		}
+
+		browser := strings.ToLower(strings.ReplaceAll(id.Browser, ":", ""))
+		if b, err := hex.DecodeString(browser); err != nil || (browser != "" && len(b) != sha256.Size) {
+			return nil, fmt.Errorf("client identity for %s: bad browser certificate fingerprint %q", id.Hosts[0], id.Browser)
+		}
+
+		cert := id.Certificate
+		identities = append(identities, &clientIdentity{
+			hosts:   hosts,
+			cert:    &cert,
+			browser: browser,
+		})
+	}
+
+	return identities, nil
+}
+
+// browserCertMapped checks whether the identity for host
+// depends on the certificate presented by the browser
+func (h *tunneler) browserCertMapped(host, port string) bool {
+	if !h.requestClientCerts {
+		return false
+	}
+	for _, id := range h.identities {
+		if id.browser != "" && id.hosts.match(host, port) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientIdentity returns the certificate presented to host on
+// the upstream leg. An identity mapped to the browser certificate
+// takes precedence over one configured for the host only.
+func (h *tunneler) clientIdentity(host, port string, browser *x509.Certificate) *tls.Certificate {
+	var fp string
+	if browser != nil {
+		sum := sha256.Sum256(browser.Raw)
+		fp = hex.EncodeToString(sum[:])
+	}
+
+	var cert *tls.Certificate
+	for _, id := range h.identities {
+		if !id.hosts.match(host, port) {
+			continue
+		}
+		if id.browser == "" && cert == nil {
+			cert = id.cert
+		}
+		if id.browser != "" && id.browser == fp {
+			return id.cert
+		}
+	}
+
+	return cert
+}
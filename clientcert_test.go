@@ -0,0 +1,130 @@
+package letsdane
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newClientCert(t *testing.T, cn string) tls.Certificate {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, priv.Public(), priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(raw)
+
+	return tls.Certificate{Certificate: [][]byte{raw}, PrivateKey: priv, Leaf: leaf}
+}
+
+func TestClientIdentity(t *testing.T) {
+	targetSrv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	targetSrv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	targetSrv.StartTLS()
+	defer targetSrv.Close()
+
+	targetIP, targetPort, _ := net.SplitHostPort(targetSrv.Listener.Addr().String())
+	proxyCA, proxyConfig := newProxyTestConfig(t)
+	proxyConfig.Resolver = &testResolver{
+		lookupIP: func(ctx context.Context, network, host string) ([]net.IP, bool, error) {
+			return []net.IP{net.ParseIP(targetIP)}, true, nil
+		},
+		lookupTLSA: func(ctx context.Context, service, proto, name string) ([]*dns.TLSA, bool, error) {
+			return newTLSA(3, 1, 1, targetSrv.Certificate()), true, nil
+		},
+	}
+
+	alice, bob, browser := newClientCert(t, "alice"), newClientCert(t, "bob"), newClientCert(t, "browser")
+	fp := sha256.Sum256(browser.Certificate[0])
+
+	daneStore := x509.NewCertPool()
+	daneStore.AddCert(proxyCA)
+
+	get := func(config *Config, clientCert *tls.Certificate) (string, error) {
+		proxyHandler, err := config.NewHandler()
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxySrv := httptest.NewServer(proxyHandler)
+		defer proxySrv.Close()
+		proxyURL, _ := url.Parse(proxySrv.URL)
+
+		tlsConfig := &tls.Config{RootCAs: daneStore}
+		if clientCert != nil {
+			tlsConfig.Certificates = []tls.Certificate{*clientCert}
+		}
+		tr := &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: tlsConfig}
+
+		resp, err := tr.RoundTrip(httptest.NewRequest("GET", "https://example.com:"+targetPort, nil))
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	if _, err := get(proxyConfig, nil); err == nil {
+		t.Fatal("no identity: got nil, want error")
+	}
+
+	proxyConfig.ClientIdentities = []*ClientIdentity{
+		{Hosts: []string{"other.example"}, Certificate: bob},
+		{Hosts: []string{"example.com:" + targetPort}, Certificate: alice},
+	}
+	if got, err := get(proxyConfig, nil); err != nil || got != "alice" {
+		t.Fatalf("got %q, %v, want alice", got, err)
+	}
+
+	// browser certificate mapped to bob
+	proxyConfig.RequestClientCerts = true
+	proxyConfig.ClientIdentities = append(proxyConfig.ClientIdentities,
+		&ClientIdentity{Hosts: []string{"*.com"}, Certificate: bob, Browser: hex.EncodeToString(fp[:])})
+
+	if got, err := get(proxyConfig, &browser); err != nil || got != "bob" {
+		t.Fatalf("mapped: got %q, %v, want bob", got, err)
+	}
+	if got, err := get(proxyConfig, nil); err != nil || got != "alice" {
+		t.Fatalf("unmapped: got %q, %v, want alice", got, err)
+	}
+	other := newClientCert(t, "other")
+	if got, err := get(proxyConfig, &other); err != nil || got != "alice" {
+		t.Fatalf("other browser certificate: got %q, %v, want alice", got, err)
+	}
+
+	proxyConfig.ClientIdentities[2].Browser = "bad"
+	if _, err := proxyConfig.NewHandler(); err == nil {
+		t.Fatal("bad fingerprint: got nil, want error")
+	}
+}
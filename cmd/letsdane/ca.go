@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/buffrr/letsdane/hsm"
+	"golang.org/x/term"
+)
+
+// caValidity is the validity period of generated CAs
+const caValidity = 365 * 24 * time.Hour
+
+// anchorDirs are directories used by common distributions
+// to add local CAs to the system trust store.
+var anchorDirs = []string{
+	"/usr/local/share/ca-certificates",
+	"/etc/pki/ca-trust/source/anchors",
+	"/etc/ca-certificates/trust-source/anchors",
+}
+
+var errPKCS11Key = errors.New("not supported for keys stored in a PKCS#11 token, manage the key with the token's tools")
+
+// writeCA writes the CA certificate and its private key
+// to certFile and keyFile. The key is encrypted if pass is not empty.
+func writeCA(certFile, keyFile string, ca *x509.Certificate, priv crypto.Signer, pass []byte) error {
+	certOut, err := os.OpenFile(certFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("couldn't create CA file: %v", err)
+	}
+	defer certOut.Close()
+
+	if err := pem.Encode(certOut, &pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: ca.Raw,
+	}); err != nil {
+		return err
+	}
+
+	return writeKey(keyFile, priv, pass)
+}
+
+// writeKey writes priv as a PKCS#8 private key to keyFile
+// encrypting it if pass is not empty.
+func writeKey(keyFile string, priv crypto.Signer, pass []byte) error {
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return err
+	}
+
+	block := &pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: der,
+	}
+	if len(pass) > 0 {
+		if block.Bytes, err = encryptPKCS8(der, pass); err != nil {
+			return err
+		}
+		block.Type = "ENCRYPTED PRIVATE KEY"
+	}
+
+	// write to a temporary file first to avoid losing
+	// the key if writing fails
+	tmp := keyFile + ".tmp"
+	if err := os.WriteFile(tmp, pem.EncodeToMemory(block), 0600); err != nil {
+		return fmt.Errorf("couldn't create CA private key file: %v", err)
+	}
+
+	return os.Rename(tmp, keyFile)
+}
+
+// caPass caches the CA passphrase once read
+var caPass string
+
+// configuredPassphrase returns the CA passphrase from the first
+// line of -pass-file or the DANE_CA_PASS environment variable.
+func configuredPassphrase() string {
+	if *passFile == "" {
+		return os.Getenv("DANE_CA_PASS")
+	}
+
+	b, err := os.ReadFile(*passFile)
+	if err != nil {
+		log.Fatalf("pass-file: %v", err)
+	}
+	line, _, _ := strings.Cut(string(b), "\n")
+	return strings.TrimSuffix(line, "\r")
+}
+
+// caPassphrase returns the passphrase used to decrypt CA keys
+// from -pass-file, DANE_CA_PASS or an interactive prompt.
+func caPassphrase(keyFile string) []byte {
+	if caPass == "" {
+		caPass = configuredPassphrase()
+	}
+	if caPass == "" && term.IsTerminal(int(os.Stdin.Fd())) {
+		p, err := readPassword(fmt.Sprintf("Enter passphrase for %s: ", keyFile))
+		if err != nil {
+			log.Fatal(err)
+		}
+		caPass = string(p)
+	}
+
+	return []byte(caPass)
+}
+
+// newPassphrase returns the passphrase used to encrypt new CA keys
+// from -pass-file, DANE_CA_PASS or an interactive prompt. It is empty
+// if the key should not be encrypted.
+func newPassphrase() []byte {
+	if caPass == "" {
+		caPass = configuredPassphrase()
+	}
+	if caPass != "" || !term.IsTerminal(int(os.Stdin.Fd())) {
+		return []byte(caPass)
+	}
+
+	p, err := promptNewPassphrase()
+	if err != nil {
+		log.Fatal(err)
+	}
+	caPass = string(p)
+	return p
+}
+
+// promptNewPassphrase asks for a new passphrase twice
+func promptNewPassphrase() ([]byte, error) {
+	for {
+		p, err := readPassword("Enter passphrase for the CA private key (empty for none): ")
+		if err != nil {
+			return nil, err
+		}
+		if len(p) == 0 {
+			return nil, nil
+		}
+
+		confirm, err := readPassword("Confirm passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(p, confirm) {
+			return p, nil
+		}
+		fmt.Fprintln(os.Stderr, "Passphrases do not match, try again.")
+	}
+}
+
+func readPassword(prompt string) ([]byte, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	defer fmt.Fprintln(os.Stderr)
+
+	return term.ReadPassword(int(os.Stdin.Fd()))
+}
+
+// caPasswd re-encrypts the CA private key (and a pending
+// successor's key) with a new passphrase
+func caPasswd(args []string) error {
+	flags := newFlagSet("ca passwd")
+	flags.Parse(args)
+
+	if hsm.IsURI(*keyPath) {
+		return errPKCS11Key
+	}
+
+	*certPath, *keyPath = getOrCreateCA()
+	nextCert, nextKey, _ := successorPaths(*certPath, *keyPath)
+
+	keys := map[string]crypto.Signer{}
+	_, keys[*keyPath] = loadKeyPair(*certPath, *keyPath)
+	if _, err := os.Stat(nextCert); err == nil {
+		_, keys[nextKey] = loadKeyPair(nextCert, nextKey)
+	}
+
+	newPass := []byte(os.Getenv("DANE_CA_NEW_PASS"))
+	if len(newPass) == 0 {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return errors.New("no terminal available, set DANE_CA_NEW_PASS to the new passphrase")
+		}
+
+		var err error
+		if newPass, err = promptNewPassphrase(); err != nil {
+			return err
+		}
+	}
+
+	for file, priv := range keys {
+		if err := writeKey(file, priv, newPass); err != nil {
+			return err
+		}
+		if len(newPass) == 0 {
+			fmt.Printf("Removed encryption from %s\n", file)
+			continue
+		}
+		fmt.Printf("Encrypted %s\n", file)
+	}
+
+	return nil
+}
+
+// withSuffix inserts suffix before the extension of p
+func withSuffix(p, suffix string) string {
+	ext := path.Ext(p)
+	return strings.TrimSuffix(p, ext) + suffix + ext
+}
+
+// successorPaths returns the file paths of a pending successor CA
+// stored next to the given CA files.
+func successorPaths(certFile, keyFile string) (nextCert, nextKey, switchover string) {
+	nextCert = withSuffix(certFile, ".next")
+	nextKey = withSuffix(keyFile, ".next")
+	switchover = strings.TrimSuffix(nextCert, path.Ext(nextCert)) + ".switchover"
+	return
+}
+
+// loadSuccessor loads a pending successor CA and its switchover time.
+// It returns a nil certificate if no rotation is in progress.
+func loadSuccessor() (*x509.Certificate, crypto.Signer, time.Time) {
+	if hsm.IsURI(*keyPath) {
+		return nil, nil, time.Time{}
+	}
+
+	nextCert, nextKey, switchoverFile := successorPaths(*certPath, *keyPath)
+	if _, err := os.Stat(nextCert); err != nil {
+		return nil, nil, time.Time{}
+	}
+
+	switchover, err := readSwitchover(switchoverFile)
+	if err != nil {
+		log.Fatalf("couldn't read CA switchover time: %v", err)
+	}
+
+	x509c, priv := loadKeyPair(nextCert, nextKey)
+	return x509c, priv, switchover
+}
+
+func readSwitchover(file string) (time.Time, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Parse(time.RFC3339, strings.TrimSpace(string(b)))
+}
+
+// caRotate generates a successor CA that will replace the current
+// one after an overlap period, or finishes a pending rotation.
+func caRotate(args []string) error {
+	flags := newFlagSet("ca rotate")
+	overlap := flags.Duration("overlap", 30*24*time.Hour, "time until the successor CA starts issuing certificates")
+	at := flags.String("at", "", "switchover date in RFC 3339 format (overrides -overlap)")
+	out := flags.String("o", "", "path to export the successor's public CA file")
+	finish := flags.Bool("finish", false, "replace the current CA with its successor")
+	force := flags.Bool("force", false, "replace an existing successor or previous CA, or finish before the switchover date")
+	flags.Parse(args)
+
+	if hsm.IsURI(*keyPath) {
+		return errPKCS11Key
+	}
+
+	*certPath, *keyPath = getOrCreateCA()
+	nextCert, nextKey, switchoverFile := successorPaths(*certPath, *keyPath)
+
+	if *finish {
+		return finishRotation(nextCert, nextKey, switchoverFile, *force)
+	}
+
+	switchover := time.Now().Add(*overlap)
+	if *at != "" {
+		var err error
+		if switchover, err = time.Parse(time.RFC3339, *at); err != nil {
+			return fmt.Errorf("bad switchover date: %v", err)
+		}
+	}
+
+	if _, err := os.Stat(nextCert); err != nil || *force {
+		ca, priv, err := newCA()
+		if err != nil {
+			return fmt.Errorf("couldn't generate CA: %v", err)
+		}
+		if err := writeCA(nextCert, nextKey, ca, priv, newPassphrase()); err != nil {
+			return err
+		}
+		if err := os.WriteFile(switchoverFile, []byte(switchover.Format(time.RFC3339)+"\n"), 0600); err != nil {
+			return err
+		}
+
+		fmt.Printf("Generated successor CA %s\n", nextCert)
+	} else {
+		fmt.Printf("A successor CA already exists: %s (use -force to replace it)\n", nextCert)
+		if switchover, err = readSwitchover(switchoverFile); err != nil {
+			return err
+		}
+	}
+
+	if *out != "" {
+		b, err := os.ReadFile(nextCert)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(*out, b, 0600); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Certificates will be issued by the successor from %s\n", switchover.Format(time.RFC3339))
+	fmt.Printf("The current CA %s remains valid until then\n\n", *certPath)
+
+	ca, _ := loadKeyPair(nextCert, nextKey)
+	printTrustStatus(ca, nextCert)
+	return nil
+}
+
+// finishRotation replaces the current CA with its successor
+// keeping the previous CA files with a .prev suffix
+func finishRotation(nextCert, nextKey, switchoverFile string, force bool) error {
+	switchover, err := readSwitchover(switchoverFile)
+	if err != nil {
+		return fmt.Errorf("no rotation in progress: %v", err)
+	}
+	if time.Now().Before(switchover) && !force {
+		return fmt.Errorf("switchover date %s not reached (use -force to finish anyway)", switchover.Format(time.RFC3339))
+	}
+
+	prevCert, prevKey := withSuffix(*certPath, ".prev"), withSuffix(*keyPath, ".prev")
+	renames := [][2]string{
+		{*certPath, prevCert},
+		{*keyPath, prevKey},
+		{nextCert, *certPath},
+		{nextKey, *keyPath},
+	}
+	for _, r := range renames {
+		if _, err := os.Stat(r[0]); err != nil {
+			return err
+		}
+	}
+	if !force {
+		for _, prev := range []string{prevCert, prevKey} {
+			if _, err := os.Stat(prev); err == nil {
+				return fmt.Errorf("%s already exists (use -force to replace it)", prev)
+			}
+		}
+	}
+	if err := renameAll(renames); err != nil {
+		return err
+	}
+	if err := os.Remove(switchoverFile); err != nil {
+		return err
+	}
+
+	fmt.Printf("Rotation finished, previous CA moved to %s\n", withSuffix(*certPath, ".prev"))
+	return nil
+}
+
+// renameAll renames each file pair in order. If a rename fails
+// the renames done so far are undone so that the CA certificate
+// and key on disk stay consistent.
+func renameAll(renames [][2]string) error {
+	for i, r := range renames {
+		err := os.Rename(r[0], r[1])
+		if err == nil {
+			continue
+		}
+
+		for j := i - 1; j >= 0; j-- {
+			if rerr := os.Rename(renames[j][1], renames[j][0]); rerr != nil {
+				var moved []string
+				for _, m := range renames[:j+1] {
+					moved = append(moved, m[0]+" -> "+m[1])
+				}
+				return fmt.Errorf("%v (rollback failed: %v, moved: %s)", err, rerr, strings.Join(moved, ", "))
+			}
+		}
+		return err
+	}
+
+	return nil
+}
+
+// printTrustStatus prints which of the trust stores that can be
+// inspected still need the given CA certificate
+func printTrustStatus(ca *x509.Certificate, file string) {
+	fmt.Println("Trust stores:")
+
+	status := func(name string, trusted bool) {
+		s := "needs the new certificate"
+		if trusted {
+			s = "ok"
+		}
+		fmt.Printf("  %-45s %s\n", name, s)
+	}
+
+	if pool, err := x509.SystemCertPool(); err == nil {
+		_, err := ca.Verify(x509.VerifyOptions{Roots: pool})
+		status("system", err == nil)
+	}
+
+	for _, dir := range anchorDirs {
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+		status(dir, dirHasCert(dir, ca))
+	}
+
+	fmt.Printf("\nBrowsers with their own store (e.g. Firefox) cannot be checked,\n"+
+		"import %s there manually.\n", file)
+}
+
+// dirHasCert checks whether any PEM file in dir contains cert
+func dirHasCert(dir string, cert *x509.Certificate) bool {
+	found := errors.New("found")
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+
+		rest, err := os.ReadFile(p)
+		if err != nil {
+			return nil
+		}
+		for {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				return nil
+			}
+			if bytes.Equal(block.Bytes, cert.Raw) {
+				return found
+			}
+		}
+	})
+
+	return err == found
+}
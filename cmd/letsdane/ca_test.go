@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFinishRotation(t *testing.T) {
+	dir := t.TempDir()
+	file := func(name string) string { return filepath.Join(dir, name) }
+	for _, name := range []string{"cert.crt", "cert.key", "cert.next.crt", "cert.next.key"} {
+		os.WriteFile(file(name), []byte(name), 0600)
+	}
+	switchover := file("switchover")
+	os.WriteFile(switchover, []byte(time.Now().Add(-time.Hour).Format(time.RFC3339)+"\n"), 0600)
+
+	oldCert, oldKey := *certPath, *keyPath
+	defer func() { *certPath, *keyPath = oldCert, oldKey }()
+	*certPath, *keyPath = file("cert.crt"), file("cert.key")
+
+	// an existing previous CA is kept unless forced
+	os.WriteFile(file("cert.prev.crt"), []byte("older"), 0600)
+	if err := finishRotation(file("cert.next.crt"), file("cert.next.key"), switchover, false); err == nil {
+		t.Fatal("finishRotation(): got nil, want error for existing .prev")
+	}
+	if b, _ := os.ReadFile(file("cert.crt")); string(b) != "cert.crt" {
+		t.Fatalf("cert.crt: got %q, want unchanged", b)
+	}
+
+	if err := finishRotation(file("cert.next.crt"), file("cert.next.key"), switchover, true); err != nil {
+		t.Fatalf("finishRotation(): got %v, want no error", err)
+	}
+	for name, want := range map[string]string{
+		"cert.crt":      "cert.next.crt",
+		"cert.key":      "cert.next.key",
+		"cert.prev.crt": "cert.crt",
+		"cert.prev.key": "cert.key",
+	} {
+		if b, _ := os.ReadFile(file(name)); string(b) != want {
+			t.Errorf("%s: got %q, want %q", name, b, want)
+		}
+	}
+}
+
+func TestRenameAll(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	os.WriteFile(a, []byte("a"), 0600)
+
+	err := renameAll([][2]string{
+		{a, b},
+		{filepath.Join(dir, "missing"), a},
+	})
+	if err == nil {
+		t.Fatal("renameAll(): got nil, want error")
+	}
+
+	// the first rename is rolled back
+	if _, err := os.Stat(a); err != nil {
+		t.Errorf("a: got %v, want restored", err)
+	}
+	if _, err := os.Stat(b); err == nil {
+		t.Error("b: got file, want rolled back")
+	}
+}
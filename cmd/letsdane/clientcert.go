@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/buffrr/letsdane"
+	"golang.org/x/term"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// loadClientIdentities reads client identities from a list file with entries:
+//
+//	<hosts> <cert.pem> <key.pem> [browser=<sha256>]
+//	<hosts> <identity.p12> [browser=<sha256>]
+//
+// hosts is a comma separated list of destinations. PKCS#12 passwords are
+// read from DANE_P12_PASS or an interactive prompt.
+func loadClientIdentities(file string) ([]*letsdane.ClientIdentity, error) {
+	entries, err := readList(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []*letsdane.ClientIdentity
+	for _, entry := range entries {
+		id, err := parseClientIdentity(entry)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+func parseClientIdentity(entry string) (*letsdane.ClientIdentity, error) {
+	fields := strings.Fields(entry)
+	id := &letsdane.ClientIdentity{}
+	if n := len(fields); n > 0 && strings.HasPrefix(fields[n-1], "browser=") {
+		id.Browser = strings.TrimPrefix(fields[n-1], "browser=")
+		fields = fields[:n-1]
+	}
+	if len(fields) < 2 || len(fields) > 3 {
+		return nil, fmt.Errorf("bad entry %q", entry)
+	}
+	id.Hosts = strings.Split(fields[0], ",")
+
+	var err error
+	if len(fields) == 3 {
+		id.Certificate, err = tls.LoadX509KeyPair(fields[1], fields[2])
+	} else {
+		id.Certificate, err = loadPKCS12(fields[1])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fields[1], err)
+	}
+
+	return id, nil
+}
+
+// loadPKCS12 loads a certificate, its chain and private key from a PKCS#12 file
+func loadPKCS12(file string) (tls.Certificate, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	password := os.Getenv("DANE_P12_PASS")
+	if password == "" && term.IsTerminal(int(os.Stdin.Fd())) {
+		p, err := readPassword(fmt.Sprintf("Enter password for %s: ", file))
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		password = string(p)
+	}
+
+	key, leaf, chain, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return tls.Certificate{}, fmt.Errorf("unsupported private key type %T", key)
+	}
+	if pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(leaf.PublicKey) {
+		return tls.Certificate{}, fmt.Errorf("no certificate matching the private key")
+	}
+
+	cert := tls.Certificate{
+		Certificate: [][]byte{leaf.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+
+	return cert, nil
+}
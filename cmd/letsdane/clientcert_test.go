@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestParseClientIdentity(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, priv.Public(), priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: raw}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+
+	id, err := parseClientIdentity("example.com,*.example.org:443 " + certFile + " " + keyFile + " browser=ab:cd")
+	if err != nil {
+		t.Fatalf("parseClientIdentity(): got %v, want no error", err)
+	}
+	if want := []string{"example.com", "*.example.org:443"}; !reflect.DeepEqual(id.Hosts, want) {
+		t.Errorf("hosts: got %v, want %v", id.Hosts, want)
+	}
+	if id.Browser != "ab:cd" {
+		t.Errorf("browser: got %q, want ab:cd", id.Browser)
+	}
+	if len(id.Certificate.Certificate) != 1 {
+		t.Errorf("got %d certificates, want 1", len(id.Certificate.Certificate))
+	}
+
+	// PKCS#12 with PBES2/AES encryption
+	p12, err := pkcs12.Modern.Encode(priv, &x509.Certificate{Raw: raw}, nil, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p12File := filepath.Join(dir, "client.p12")
+	os.WriteFile(p12File, p12, 0600)
+	t.Setenv("DANE_P12_PASS", "secret")
+
+	id, err = parseClientIdentity("example.net " + p12File)
+	if err != nil {
+		t.Fatalf("parseClientIdentity(%q): got %v, want no error", p12File, err)
+	}
+	if len(id.Certificate.Certificate) != 1 || !reflect.DeepEqual(id.Certificate.Certificate[0], raw) {
+		t.Errorf("p12 certificate: got %d certificates, want the client certificate", len(id.Certificate.Certificate))
+	}
+
+	t.Setenv("DANE_P12_PASS", "wrong")
+	if _, err := parseClientIdentity("example.net " + p12File); err == nil {
+		t.Errorf("parseClientIdentity(%q): got no error with wrong password", p12File)
+	}
+
+	for _, bad := range []string{
+		"example.com",
+		"example.com " + certFile + " " + keyFile + " extra",
+		"example.com " + keyFile + " " + certFile,
+		"example.com " + filepath.Join(dir, "missing.p12"),
+	} {
+		if _, err := parseClientIdentity(bad); err == nil {
+			t.Errorf("parseClientIdentity(%q): got no error", bad)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// command is a letsdane subcommand such as "ca rotate"
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+
+	// noTLDs runs the command without loading the TLD
+	// list so that it works even if the list is corrupt
+	noTLDs bool
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{
+			name:  "ca rotate",
+			usage: "generate a successor CA or finish a pending rotation",
+			run:   caRotate,
+		},
+		{
+			name:  "ca passwd",
+			usage: "change the passphrase of the CA private key",
+			run:   caPasswd,
+		},
+		{
+			name:   "tld update",
+			usage:  "install a new TLD list (IANA format) for -skip-icann",
+			run:    tldUpdate,
+			noTLDs: true,
+		},
+		{
+			name:  "pins list",
+			usage: "list hosts with learned DANE pins",
+			run:   pinsList,
+		},
+		{
+			name:  "pins clear",
+			usage: "remove learned DANE pins",
+			run:   pinsClear,
+		},
+	}
+}
+
+// findCommand returns the subcommand matching args or nil
+func findCommand(args []string) *command {
+	for _, cmd := range commands {
+		name := strings.Fields(cmd.name)
+		if len(args) >= len(name) && strings.Join(args[:len(name)], " ") == cmd.name {
+			return cmd
+		}
+	}
+
+	return nil
+}
+
+// runCommand runs the subcommand matching args
+func runCommand(args []string) error {
+	cmd := findCommand(args)
+	if cmd == nil {
+		return fmt.Errorf("unknown command %q (see letsdane -help)", strings.Join(args, " "))
+	}
+
+	return cmd.run(args[len(strings.Fields(cmd.name)):])
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [options] [command]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-16s %s\n", cmd.name, cmd.usage)
+	}
+	fmt.Fprintf(out, "\nOptions:\n")
+	flag.PrintDefaults()
+}
+
+// newFlagSet creates a flag set for the named subcommand
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet("letsdane "+name, flag.ExitOnError)
+}
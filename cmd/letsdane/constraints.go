@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/buffrr/letsdane"
+)
+
+// tldFileName is the name of the TLD list in the conf dir
+const tldFileName = "tlds-alpha-by-domain.txt"
+
+var (
+	tldPath = flag.String("tlds", "", "path to an IANA format TLD list used for -skip-icann (default: ~/.letsdane/"+tldFileName+", falls back to the built-in list)")
+	permit  = flag.String("permit", "", "space separated list of zones to use DANE for, others are passed through and the CA is restricted to these zones")
+)
+
+// parseTLDs parses a TLD list in the format of
+// https://data.iana.org/TLD/tlds-alpha-by-domain.txt
+// returning the TLDs and the version from the header comment.
+func parseTLDs(r io.Reader) (map[string]struct{}, string, error) {
+	tlds := make(map[string]struct{})
+	version := ""
+
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.ToLower(strings.TrimSpace(sc.Text()))
+		if line == "" {
+			continue
+		}
+		if line[0] == '#' {
+			if version == "" {
+				version = strings.TrimSpace(line[1:])
+			}
+			continue
+		}
+		if strings.ContainsAny(line, ". \t") {
+			return nil, "", fmt.Errorf("bad tld %q", line)
+		}
+
+		tlds[line] = struct{}{}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, "", err
+	}
+	if len(tlds) == 0 {
+		return nil, "", errors.New("no tlds found")
+	}
+
+	return tlds, version, nil
+}
+
+// getTLDPath returns the path of the TLD list
+func getTLDPath() string {
+	if *tldPath != "" {
+		return *tldPath
+	}
+
+	return path.Join(getConfPath(), tldFileName)
+}
+
+// nameConstraints are the TLDs excluded from DANE lookups and
+// from the CA certificate when -skip-icann is set
+var nameConstraints map[string]struct{}
+
+// permittedZones are the only zones DANE is used for when -permit is set
+var permittedZones map[string]struct{}
+
+// parseZones parses a space separated list of zones
+func parseZones(s string) (map[string]struct{}, error) {
+	zones := make(map[string]struct{})
+	for _, zone := range strings.Fields(s) {
+		zone = strings.Trim(strings.ToLower(zone), ".")
+		if zone == "" || strings.Contains(zone, "..") {
+			return nil, fmt.Errorf("bad zone %q", zone)
+		}
+		zones[zone] = struct{}{}
+	}
+	if len(zones) == 0 {
+		return nil, errors.New("no zones")
+	}
+
+	return zones, nil
+}
+
+// newCA generates a CA private key and certificate
+func newCA() (*x509.Certificate, crypto.Signer, error) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ca, err := newAuthority(priv)
+	return ca, priv, err
+}
+
+// newAuthority creates a CA certificate for priv restricted
+// to the permitted zones or excluding the ICANN TLDs
+func newAuthority(priv crypto.Signer) (*x509.Certificate, error) {
+	if permittedZones != nil {
+		return letsdane.NewPermittedAuthority("DNSSEC", "DNSSEC", caValidity, permittedZones, priv)
+	}
+
+	return letsdane.NewAuthorityWithSigner("DNSSEC", "DNSSEC", caValidity, nameConstraints, priv)
+}
+
+// loadTLDs returns the TLD list from the TLD file or the built-in
+// list if the file doesn't exist.
+func loadTLDs() (tlds map[string]struct{}, version string, err error) {
+	f, err := os.Open(getTLDPath())
+	if errors.Is(err, os.ErrNotExist) && *tldPath == "" {
+		return builtinTLDs, builtinTLDVersion + " (built-in)", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	tlds, version, err = parseTLDs(f)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %v", f.Name(), err)
+	}
+
+	return tlds, version + " (" + f.Name() + ")", nil
+}
+
+// constraintsDiff compares the names excluded by the CA with the
+// given TLDs. added are TLDs not excluded by the CA and removed
+// are names excluded by the CA that are no longer in tlds.
+func constraintsDiff(ca *x509.Certificate, tlds map[string]struct{}) (added, removed []string) {
+	return namesDiff(ca.ExcludedDNSDomains, tlds)
+}
+
+// namesDiff compares the names in a CA's name constraints with set
+func namesDiff(names []string, set map[string]struct{}) (added, removed []string) {
+	seen := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		name = strings.TrimPrefix(name, ".")
+		seen[name] = struct{}{}
+		if _, ok := set[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+
+	for name := range set {
+		if _, ok := seen[name]; !ok {
+			added = append(added, name)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	return
+}
+
+// checkConstraints warns if the name constraints of the CA
+// don't match the active TLD list
+func checkConstraints(ca *x509.Certificate) {
+	if permittedZones != nil {
+		added, removed := namesDiff(ca.PermittedDNSDomains, permittedZones)
+		if len(ca.PermittedDNSDomains) == 0 {
+			log.Printf("warning: CA %s is not restricted to the permitted zones", ca.Subject.CommonName)
+		} else if len(added) > 0 || len(removed) > 0 {
+			log.Printf("warning: the permitted zones of CA %s (%s) don't match -permit", ca.Subject.CommonName,
+				strings.Join(ca.PermittedDNSDomains, " "))
+		} else {
+			return
+		}
+		log.Printf("Run `letsdane -permit ... ca rotate` to re-issue the CA for the permitted zones")
+		return
+	}
+	if len(ca.PermittedDNSDomains) > 0 {
+		log.Printf("warning: CA %s is restricted to %s but -permit is not set, "+
+			"DANE certificates for other names will be rejected", ca.Subject.CommonName, strings.Join(ca.PermittedDNSDomains, " "))
+	}
+
+	if nameConstraints == nil {
+		if len(ca.ExcludedDNSDomains) > 0 {
+			log.Printf("warning: CA %s excludes ICANN TLDs but -skip-icann is not set, "+
+				"DANE certificates for these TLDs will be rejected", ca.Subject.CommonName)
+		}
+		return
+	}
+
+	added, removed := constraintsDiff(ca, nameConstraints)
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+
+	log.Printf("warning: the name constraints of CA %s don't match the active TLD list", ca.Subject.CommonName)
+	if len(added) > 0 {
+		log.Printf("warning: %d TLDs are not excluded by the CA: %s", len(added), summarize(added))
+	}
+	if len(removed) > 0 {
+		log.Printf("warning: %d TLDs are excluded by the CA but no longer in the list: %s", len(removed), summarize(removed))
+	}
+	log.Printf("Run `letsdane -skip-icann ca rotate` to re-issue the CA with the active TLD list")
+}
+
+// summarize returns the first few names of a list
+func summarize(names []string) string {
+	const max = 10
+	if len(names) > max {
+		return strings.Join(names[:max], ", ") + ", ..."
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// tldUpdate installs a new TLD list read from a local file
+func tldUpdate(args []string) error {
+	flags := newFlagSet("tld update")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: letsdane tld update <tlds-alpha-by-domain.txt>\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	b, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	tlds, version, err := parseTLDs(bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("%s: %v", flags.Arg(0), err)
+	}
+
+	// compare with the list currently in use
+	current, _, err := loadTLDs()
+	if err != nil {
+		current = builtinTLDs
+	}
+	var added, removed int
+	for tld := range tlds {
+		if _, ok := current[tld]; !ok {
+			added++
+		}
+	}
+	for tld := range current {
+		if _, ok := tlds[tld]; !ok {
+			removed++
+		}
+	}
+
+	dst := getTLDPath()
+	if err := os.WriteFile(dst+".tmp", b, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(dst+".tmp", dst); err != nil {
+		return err
+	}
+
+	fmt.Printf("Installed %d TLDs (%s) to %s: %d added, %d removed\n", len(tlds), version, dst, added, removed)
+	if added > 0 || removed > 0 {
+		fmt.Printf("Run `letsdane -skip-icann ca rotate` to re-issue the CA with the new name constraints\n")
+	}
+	return nil
+}
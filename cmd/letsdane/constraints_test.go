@@ -0,0 +1,66 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buffrr/letsdane"
+)
+
+func TestParseTLDs(t *testing.T) {
+	list := "# Version 2020092500, Last Updated Fri Sep 25 07:07:02 2020 UTC\nAAA\n\nCOM\nXN--P1AI\n"
+	tlds, version, err := parseTLDs(strings.NewReader(list))
+	if err != nil {
+		t.Fatalf("parseTLDs(): got %v, want no error", err)
+	}
+	if version != "version 2020092500, last updated fri sep 25 07:07:02 2020 utc" {
+		t.Errorf("version: got %q", version)
+	}
+
+	want := map[string]struct{}{"aaa": {}, "com": {}, "xn--p1ai": {}}
+	if !reflect.DeepEqual(tlds, want) {
+		t.Errorf("parseTLDs(): got %v, want %v", tlds, want)
+	}
+
+	for _, bad := range []string{"", "# comment only\n", "example.com\n"} {
+		if _, _, err := parseTLDs(strings.NewReader(bad)); err == nil {
+			t.Errorf("parseTLDs(%q): got no error", bad)
+		}
+	}
+}
+
+func TestConstraintsDiff(t *testing.T) {
+	ca, _, err := letsdane.NewAuthority("DNSSEC", "DNSSEC", time.Hour, map[string]struct{}{"com": {}, "org": {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	added, removed := constraintsDiff(ca, map[string]struct{}{"com": {}, "org": {}})
+	if len(added) != 0 || len(removed) != 0 {
+		t.Errorf("constraintsDiff(): got %v, %v, want no difference", added, removed)
+	}
+
+	added, removed = constraintsDiff(ca, map[string]struct{}{"com": {}, "net": {}})
+	if !reflect.DeepEqual(added, []string{"net"}) || !reflect.DeepEqual(removed, []string{"org"}) {
+		t.Errorf("constraintsDiff(): got %v, %v, want [net], [org]", added, removed)
+	}
+}
+
+func TestParseZones(t *testing.T) {
+	zones, err := parseZones(" 3b  Example.ORG. ")
+	if err != nil {
+		t.Fatalf("parseZones(): got %v, want no error", err)
+	}
+	want := map[string]struct{}{"3b": {}, "example.org": {}}
+	if !reflect.DeepEqual(zones, want) {
+		t.Errorf("parseZones(): got %v, want %v", zones, want)
+	}
+
+	for _, bad := range []string{"", " ", ".", "a..b"} {
+		if _, err := parseZones(bad); err == nil {
+			t.Errorf("parseZones(%q): got no error", bad)
+		}
+	}
+}
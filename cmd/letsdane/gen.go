@@ -24,10 +24,12 @@ func main() {
 	defer resp.Body.Close()
 	var sb bytes.Buffer
 
-	h := fmt.Sprintf(`// source: %s
+	h := `// source: %s
 
-var nameConstraints = map[string]struct{} {
-`, source)
+const builtinTLDVersion = %q
+
+var builtinTLDs = map[string]struct{} {
+`
 
 	sc := bufio.NewScanner(resp.Body)
 	for sc.Scan() {
@@ -36,7 +38,7 @@ var nameConstraints = map[string]struct{} {
 			sb.WriteString("package main\n\n")
 			sb.WriteString("// auto generated do not edit\n")
 			sb.WriteString("//" + line[1:] + "\n")
-			sb.WriteString(h)
+			sb.WriteString(fmt.Sprintf(h, source, strings.TrimSpace(line[1:])))
 			continue
 		}
 
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// htpasswd authenticates proxy clients against
+// bcrypt entries of an htpasswd file
+type htpasswd struct {
+	hashes map[string][]byte
+
+	// verified caches a digest of the last password that
+	// matched each user to avoid bcrypt on every request
+	mu       sync.Mutex
+	verified map[string][sha256.Size]byte
+}
+
+// loadHtpasswd reads an htpasswd file with one user:hash entry per line.
+// Only bcrypt hashes (htpasswd -B) are accepted.
+func loadHtpasswd(file string) (*htpasswd, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := &htpasswd{
+		hashes:   make(map[string][]byte),
+		verified: make(map[string][sha256.Size]byte),
+	}
+
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d: want user:hash", n)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("line %d: user %s: only bcrypt hashes are supported", n, user)
+		}
+		h.hashes[user] = []byte(hash)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(h.hashes) == 0 {
+		return nil, fmt.Errorf("no users in %s", file)
+	}
+
+	return h, nil
+}
+
+func (h *htpasswd) authenticate(username, password string) bool {
+	hash, ok := h.hashes[username]
+	if !ok {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(password))
+	h.mu.Lock()
+	cached, ok := h.verified[username]
+	h.mu.Unlock()
+	if ok && subtle.ConstantTimeCompare(cached[:], sum[:]) == 1 {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+
+	h.mu.Lock()
+	h.verified[username] = sum
+	h.mu.Unlock()
+	return true
+}
+
+// parseCIDRs parses comma separated networks or a file listing
+// one network per line. Addresses without a prefix length
+// are treated as a single host.
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	entries := strings.Split(s, ",")
+	if _, err := os.Stat(s); err == nil {
+		if entries, err = readList(s); err != nil {
+			return nil, err
+		}
+	}
+
+	var nets []*net.IPNet
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if !strings.Contains(e, "/") {
+			ip := net.ParseIP(e)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %s", e)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
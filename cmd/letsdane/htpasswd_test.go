@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoadHtpasswd(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "htpasswd")
+	os.WriteFile(file, []byte("# users\nalice:"+string(hash)+"\n"), 0600)
+
+	h, err := loadHtpasswd(file)
+	if err != nil {
+		t.Fatalf("loadHtpasswd(): got %v, want no error", err)
+	}
+
+	for _, test := range []struct {
+		user, pass string
+		want       bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "secret", true}, // cached
+		{"alice", "wrong", false},
+		{"bob", "secret", false},
+	} {
+		if got := h.authenticate(test.user, test.pass); got != test.want {
+			t.Errorf("authenticate(%s, %s): got %v, want %v", test.user, test.pass, got, test.want)
+		}
+	}
+
+	// apr1 and sha entries are rejected at load time
+	os.WriteFile(file, []byte("alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0600)
+	if _, err := loadHtpasswd(file); err == nil {
+		t.Error("loadHtpasswd(): got no error for a sha1 entry")
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := parseCIDRs("10.0.0.0/8, 192.0.2.1,::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nets) != 3 {
+		t.Fatalf("got %d networks, want 3", len(nets))
+	}
+	if !nets[1].Contains(net.ParseIP("192.0.2.1")) || nets[1].Contains(net.ParseIP("192.0.2.2")) {
+		t.Errorf("got %v, want a single host network", nets[1])
+	}
+
+	if _, err := parseCIDRs("10.0.0.0/33"); err == nil {
+		t.Error("got no error for an invalid network")
+	}
+}
@@ -1,7 +1,8 @@
 package main
 
 import (
-	"bytes"
+	"crypto"
+	"crypto/subtle"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
@@ -18,6 +19,7 @@ import (
 
 	"github.com/buffrr/hsig0"
 	"github.com/buffrr/letsdane"
+	"github.com/buffrr/letsdane/hsm"
 	rs "github.com/buffrr/letsdane/resolver"
 	"github.com/miekg/dns"
 )
@@ -30,14 +32,40 @@ var (
 	conf           = flag.String("conf", "", "dir path to store configuration (default: ~/.letsdane)")
 	addr           = flag.String("addr", ":8080", "host:port of the proxy")
 	certPath       = flag.String("cert", "", "filepath to custom CA")
-	keyPath        = flag.String("key", "", "filepath to the CA's private key")
-	pass           = flag.String("pass", "", "CA passphrase or use DANE_CA_PASS environment variable to decrypt CA file (if encrypted)")
+	keyPath        = flag.String("key", "", "filepath to the CA's private key or a pkcs11: URI (see README)")
+	passFile       = flag.String("pass-file", "", "read the CA passphrase used to encrypt new and decrypt existing CA keys from this file (default: DANE_CA_PASS environment variable or prompt)")
 	anchor         = flag.String("anchor", "", "path to trust anchor file (default: hardcoded 2017 KSK)")
 	verbose        = flag.Bool("verbose", false, "verbose output for debugging")
 	ad             = flag.Bool("skip-dnssec", false, "check ad flag only without dnssec validation")
 	skipICANN      = flag.Bool("skip-icann", false, "skip TLSA lookups for ICANN tlds and include them in the CA name constraints extension")
-	validity       = flag.Duration("validity", time.Hour, "window of time generated DANE certificates are valid")
+	validity       = flag.Duration("validity", time.Hour, "window of time generated DANE certificates are valid (capped at the TLSA TTL)")
 	skipNameChecks = flag.Bool("skip-namechecks", false, "disable name checks when matching DANE-EE TLSA reocrds.")
+	requireDANE    = flag.String("require-dane", "", "path to a file listing domains (or *.domain wildcards) that must use DANE, one per line")
+	bypass         = flag.String("bypass", "", "path to a file listing destinations (domains or *.domain wildcards, optionally with :port) to pass through without DANE, one per line")
+	strictPKIX     = flag.Bool("strict-pkix", false, "intercept sites without DANE as well and only issue certificates if they validate against the PKIX roots")
+	pkixRoots      = flag.String("pkix-roots", "", "path to a PEM file of root certificates used by -strict-pkix (default: system roots)")
+	errorPage      = flag.Bool("error-page", false, "show an error page describing the failure in the browser when a site can't be authenticated")
+	allowOverride  = flag.Bool("allow-override", false, "allow proceeding to sites failing validation for a limited time from the error page (implies -error-page)")
+	pinMaxAge      = flag.Duration("pin-max-age", 0, "remember hosts with valid DANE for this duration and refuse to pass them through without secure TLSA records (0 disables pinning)")
+	listenTLS      = flag.Bool("tls", false, "serve the proxy over TLS (HTTPS proxy) with a certificate issued by the CA")
+	tlsNames       = flag.String("tls-names", "", "comma separated names of the proxy used with -tls (default: the -addr host, localhost and the hostname)")
+	tlsCert        = flag.String("tls-cert", "", "path to a PEM certificate used to serve the proxy over TLS instead of one issued by the CA")
+	tlsKey         = flag.String("tls-key", "", "path to the private key of -tls-cert")
+	socksAddr      = flag.String("socks", "", "host:port to additionally serve SOCKS5 clients on")
+	socksUser      = flag.String("socks-user", "", "require SOCKS5 username/password authentication with this username and the password from DANE_SOCKS_PASS")
+	requireDNSSEC  = flag.Bool("require-dnssec", false, "refuse plain http requests to names whose addresses aren't dnssec secure")
+	upgradeHTTP    = flag.String("upgrade-http", "", "upgrade plain http requests to hosts with secure TLSA records for port 443: redirect or fetch")
+	upstream       = flag.String("upstream", "", "parent proxy url (http://, https:// or socks5h:// with optional user:pass@) used to reach destinations")
+	upstreamRoutes = flag.String("upstream-routes", "", "path to a file routing destinations to parent proxies (see README)")
+	proxyAuth      = flag.String("proxy-auth", "", "path to an htpasswd file (bcrypt entries) used to require Basic proxy authentication")
+	allowCIDR      = flag.String("allow-cidr", "", "comma separated networks (or a file listing them) allowed to use the proxy (default: any)")
+	transparent    = flag.String("transparent", "", "host:port to additionally serve connections redirected by iptables/nftables on (linux only)")
+	tproxy         = flag.Bool("tproxy", false, "connections to -transparent are redirected with TPROXY instead of REDIRECT (requires CAP_NET_ADMIN)")
+	proxyProtocol  = flag.String("proxy-protocol", "", "comma separated networks (or a file listing them) of load balancers whose PROXY protocol headers are accepted")
+	clientCerts    = flag.String("client-certs", "", "path to a file mapping destinations to client certificates presented on the upstream leg (see README)")
+	requestCert    = flag.Bool("request-client-cert", false, "request a client certificate from the browser for destinations with identities mapped to browser certificates")
+	crl            = flag.Bool("crl", false, "embed a CRL distribution point in issued certificates and revoke them once DANE validation no longer holds")
+	crlURL         = flag.String("crl-url", "", "base url of the CRL distribution point (default: http://<addr>/crl)")
 	version        = flag.Bool("version", false, "Show version")
 )
 
@@ -72,36 +100,14 @@ func getOrCreateCA() (string, string) {
 
 	if _, err := os.Stat(certPath); err != nil {
 		if _, err := os.Stat(keyPath); err != nil {
-			ca, priv, err := letsdane.NewAuthority("DNSSEC", "DNSSEC", 365*24*time.Hour, nameConstraints)
+			ca, priv, err := newCA()
 			if err != nil {
 				log.Fatalf("couldn't generate CA: %v", err)
 			}
 
-			certOut, err := os.OpenFile(certPath, os.O_CREATE|os.O_WRONLY, 0644)
-			if err != nil {
-				log.Fatalf("couldn't create CA file: %v", err)
+			if err := writeCA(certPath, keyPath, ca, priv, newPassphrase()); err != nil {
+				log.Fatal(err)
 			}
-			defer certOut.Close()
-
-			pem.Encode(certOut, &pem.Block{
-				Type:  "CERTIFICATE",
-				Bytes: ca.Raw,
-			})
-
-			privOut := bytes.NewBuffer([]byte{})
-			pem.Encode(privOut, &pem.Block{
-				Type:  "RSA PRIVATE KEY",
-				Bytes: x509.MarshalPKCS1PrivateKey(priv),
-			})
-
-			kOut, err := os.OpenFile(keyPath, os.O_CREATE|os.O_WRONLY, 0600)
-			if err != nil {
-				log.Fatalf("couldn't create CA private key file: %v", err)
-			}
-			defer kOut.Close()
-
-			kOut.Write(privOut.Bytes())
-			return certPath, keyPath
 		}
 	}
 	return certPath, keyPath
@@ -119,45 +125,60 @@ func loadX509KeyPair(certFile, keyFile string) (tls.Certificate, error) {
 	}
 
 	block, _ := pem.Decode(keyPEMBlock)
-	var decryptedBlock []byte
+	if block == nil {
+		return tls.Certificate{}, fmt.Errorf("%s: no PEM data found", keyFile)
+	}
 
-	if x509.IsEncryptedPEMBlock(block) {
-		if *pass == "" {
-			*pass = os.Getenv("DANE_CA_PASS")
+	switch {
+	case block.Type == "ENCRYPTED PRIVATE KEY":
+		der, err := decryptPKCS8(block.Bytes, caPassphrase(keyFile))
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("%s: %v", keyFile, err)
 		}
-
-		decryptedBlock, err = x509.DecryptPEMBlock(block, []byte(*pass))
+		keyPEMBlock = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	case x509.IsEncryptedPEMBlock(block):
+		// legacy RFC 1423 encryption, `letsdane ca passwd` converts
+		// the key to encrypted PKCS#8
+		der, err := x509.DecryptPEMBlock(block, caPassphrase(keyFile))
 		if err != nil {
-			log.Fatalf("decryption failed: %v", err)
+			return tls.Certificate{}, fmt.Errorf("%s: decryption failed: %v", keyFile, err)
 		}
-	} else {
-		decryptedBlock = keyPEMBlock
+		keyPEMBlock = pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der})
 	}
 
-	return tls.X509KeyPair(certPEMBlock, decryptedBlock)
+	return tls.X509KeyPair(certPEMBlock, keyPEMBlock)
 }
 
-func loadCA() (*x509.Certificate, interface{}) {
-	var x509c *x509.Certificate
-	var priv interface{}
+func loadCA() (*x509.Certificate, crypto.Signer) {
+	if hsm.IsURI(*keyPath) {
+		return loadTokenCA()
+	}
 
 	*certPath, *keyPath = getOrCreateCA()
 	if *certPath != "" && *keyPath != "" {
-		cert, err := loadX509KeyPair(*certPath, *keyPath)
-		if err != nil {
-			log.Fatal(err)
-		}
+		return loadKeyPair(*certPath, *keyPath)
+	}
 
-		priv = cert.PrivateKey
-		x509c, err = x509.ParseCertificate(cert.Certificate[0])
-		if err != nil {
-			log.Fatal(err)
-		}
+	return nil, nil
+}
 
-		return x509c, priv
+func loadKeyPair(certFile, keyFile string) (*x509.Certificate, crypto.Signer) {
+	cert, err := loadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	return nil, nil
+	x509c, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	priv, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		log.Fatalf("%s: unsupported private key type", keyFile)
+	}
+
+	return x509c, priv
 }
 
 func isLoopback(r string) bool {
@@ -237,6 +258,62 @@ func setupUnbound() (u *rs.Recursive, err error) {
 	return
 }
 
+// localURL returns the url of path p served by the proxy listening on addr
+func localURL(addr, p string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		log.Fatalf("bad addr: %v", err)
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+
+	scheme := "http"
+	if *listenTLS {
+		host = listenNames(addr)[0]
+		scheme = "https"
+	}
+	if *tlsCert != "" {
+		scheme = "https"
+	}
+
+	return scheme + "://" + net.JoinHostPort(host, port) + p
+}
+
+// listenNames returns the names of the proxy used for
+// certificates issued by the CA when serving TLS
+func listenNames(addr string) []string {
+	if *tlsNames != "" {
+		return strings.Split(*tlsNames, ",")
+	}
+
+	var names []string
+	if host, _, err := net.SplitHostPort(addr); err == nil && host != "" && net.ParseIP(host) == nil {
+		names = append(names, host)
+	}
+	names = append(names, "localhost")
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		names = append(names, hostname)
+	}
+
+	return names
+}
+
+// loadRoots reads a PEM file of root certificates
+func loadRoots(file string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%s: no certificates found", file)
+	}
+
+	return roots, nil
+}
+
 var errNoKey = errors.New("no key found")
 
 // parses hsd format: key@host:port
@@ -252,14 +329,48 @@ func splitHostPortKey(addr string) (hostport string, key *hsig0.PublicKey, err e
 }
 
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 	if *version {
 		fmt.Printf("Version %s\n", letsdane.Version)
 		return
 	}
 
-	if !*skipICANN {
-		nameConstraints = nil
+	if *permit != "" {
+		if *skipICANN {
+			log.Fatal("-permit and -skip-icann can't be used together")
+		}
+
+		zones, err := parseZones(*permit)
+		if err != nil {
+			log.Fatalf("permit: %v", err)
+		}
+		permittedZones = zones
+	}
+
+	if cmd := findCommand(flag.Args()); cmd != nil && cmd.noTLDs {
+		if err := runCommand(flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *skipICANN {
+		tlds, version, err := loadTLDs()
+		if err != nil {
+			log.Fatalf("tlds: %v", err)
+		}
+		nameConstraints = tlds
+		if flag.NArg() == 0 {
+			log.Printf("Using TLD list %s", version)
+		}
+	}
+
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
 	ca, priv := loadCA()
@@ -267,6 +378,7 @@ func main() {
 		exportCA()
 		return
 	}
+	checkConstraints(ca)
 
 	var resolver rs.Resolver
 	var sig0, secure bool
@@ -320,10 +432,154 @@ func main() {
 		Validity:       *validity,
 		Resolver:       resolver,
 		Constraints:    nameConstraints,
+		Permitted:      permittedZones,
 		SkipNameChecks: *skipNameChecks,
+		ErrorPages:     *errorPage,
+		RequireDNSSEC:  *requireDNSSEC,
 		Verbose:        *verbose,
 	}
 
-	log.Printf("Listening on %s", *addr)
+	if *requireDANE != "" {
+		if c.RequireDANE, err = readList(*requireDANE); err != nil {
+			log.Fatalf("require-dane: %v", err)
+		}
+	}
+
+	if *bypass != "" {
+		if c.Bypass, err = readList(*bypass); err != nil {
+			log.Fatalf("bypass: %v", err)
+		}
+	}
+
+	if *strictPKIX {
+		c.StrictPKIX = true
+		if *pkixRoots != "" {
+			if c.PKIXRoots, err = loadRoots(*pkixRoots); err != nil {
+				log.Fatalf("pkix-roots: %v", err)
+			}
+		}
+	}
+
+	if *allowOverride {
+		c.ErrorPages = true
+		c.OverrideURL = localURL(*addr, "/override")
+		c.OverrideFile = path.Join(getConfPath(), "overrides.json")
+	}
+
+	if *pinMaxAge > 0 {
+		c.PinMaxAge = *pinMaxAge
+		c.PinFile = pinFile()
+	}
+
+	if *tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatalf("tls-cert: %v", err)
+		}
+		c.ListenCertificate = &cert
+	} else if *listenTLS {
+		c.ListenNames = listenNames(*addr)
+	}
+
+	if *socksAddr != "" {
+		c.SOCKSAddr = *socksAddr
+		if *socksUser != "" {
+			password := os.Getenv("DANE_SOCKS_PASS")
+			if password == "" {
+				log.Fatal("socks-user: DANE_SOCKS_PASS must be set")
+			}
+			c.SOCKSAuth = func(username, pass string) bool {
+				userOK := subtle.ConstantTimeCompare([]byte(username), []byte(*socksUser)) == 1
+				passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(password)) == 1
+				return userOK && passOK
+			}
+		}
+	}
+
+	switch *upgradeHTTP {
+	case "":
+	case "redirect":
+		c.UpgradeHTTP = letsdane.UpgradeRedirect
+	case "fetch":
+		c.UpgradeHTTP = letsdane.UpgradeFetch
+	default:
+		log.Fatalf("upgrade-http: want redirect or fetch, got %q", *upgradeHTTP)
+	}
+
+	if *upstream != "" {
+		if c.Upstream, err = parseProxyURL(*upstream); err != nil {
+			log.Fatalf("upstream: %v", err)
+		}
+	}
+
+	if *upstreamRoutes != "" {
+		if c.UpstreamRoutes, err = loadUpstreamRoutes(*upstreamRoutes); err != nil {
+			log.Fatalf("upstream-routes: %v", err)
+		}
+	}
+
+	if *proxyAuth != "" {
+		h, err := loadHtpasswd(*proxyAuth)
+		if err != nil {
+			log.Fatalf("proxy-auth: %v", err)
+		}
+		c.Authenticate = h.authenticate
+	}
+
+	if *allowCIDR != "" {
+		if c.AllowedNets, err = parseCIDRs(*allowCIDR); err != nil {
+			log.Fatalf("allow-cidr: %v", err)
+		}
+	}
+
+	if *transparent != "" {
+		c.TransparentAddr = *transparent
+		c.TransparentTPROXY = *tproxy
+	}
+
+	if *proxyProtocol != "" {
+		if c.ProxyProtocolNets, err = parseCIDRs(*proxyProtocol); err != nil {
+			log.Fatalf("proxy-protocol: %v", err)
+		}
+	}
+
+	if *clientCerts != "" {
+		if c.ClientIdentities, err = loadClientIdentities(*clientCerts); err != nil {
+			log.Fatalf("client-certs: %v", err)
+		}
+		c.RequestClientCerts = *requestCert
+	}
+
+	if *crl || *crlURL != "" {
+		c.CRLURL = *crlURL
+		if c.CRLURL == "" {
+			c.CRLURL = localURL(*addr, "/crl")
+		}
+		c.InventoryFile = path.Join(getConfPath(), "issued.json")
+	}
+
+	if next, nextPriv, switchover := loadSuccessor(); next != nil {
+		checkConstraints(next)
+		c.Successor = next
+		c.SuccessorPrivateKey = nextPriv
+		c.SwitchoverTime = switchover
+		if time.Now().Before(switchover) {
+			log.Printf("CA rotation pending: successor will issue certificates from %s", switchover.Format(time.RFC3339))
+		} else {
+			log.Printf("CA rotation: issuing with successor since %s, run `letsdane ca rotate -finish` to retire the previous CA", switchover.Format(time.RFC3339))
+		}
+	}
+
+	if c.ListenCertificate != nil || len(c.ListenNames) > 0 {
+		log.Printf("Listening on %s (TLS)", *addr)
+	} else {
+		log.Printf("Listening on %s", *addr)
+	}
+	if c.SOCKSAddr != "" {
+		log.Printf("Listening on %s (SOCKS5)", c.SOCKSAddr)
+	}
+	if c.TransparentAddr != "" {
+		log.Printf("Listening on %s (transparent)", c.TransparentAddr)
+	}
 	log.Fatal(c.Run(*addr))
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"text/tabwriter"
+	"time"
+
+	"github.com/buffrr/letsdane"
+)
+
+// pinFileName is the name of the DANE pin store in the conf dir
+const pinFileName = "dane-pins.json"
+
+func pinFile() string {
+	return path.Join(getConfPath(), pinFileName)
+}
+
+// pinsList prints the learned DANE pins
+func pinsList(args []string) error {
+	flags := newFlagSet("pins list")
+	flags.Parse(args)
+
+	pins, err := letsdane.ReadPins(pinFile())
+	if err != nil {
+		return err
+	}
+	if len(pins) == 0 {
+		fmt.Println("No DANE pins")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tPORT\tFIRST SEEN\tLAST SEEN\tEXPIRES")
+	for _, p := range pins {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", p.Host, p.Port,
+			p.FirstSeen.Format(time.RFC3339), p.LastSeen.Format(time.RFC3339), p.Expires.Format(time.RFC3339))
+	}
+
+	return w.Flush()
+}
+
+// pinsClear removes learned DANE pins for the given hosts or all pins
+func pinsClear(args []string) error {
+	flags := newFlagSet("pins clear")
+	all := flags.Bool("all", false, "remove all pins")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: letsdane pins clear [-all] [host ...]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 && !*all {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	n, err := letsdane.ClearPins(pinFile(), flags.Args()...)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed %d pin(s)\n", n)
+	return nil
+}
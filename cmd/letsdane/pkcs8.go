@@ -0,0 +1,238 @@
+package main
+
+// encrypted PKCS#8 private keys (RFC 5958) using PBES2 (RFC 8018)
+// with scrypt (RFC 7914) or PBKDF2 as key derivation functions
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+var (
+	oidPBES2  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidScrypt = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11591, 4, 11}
+
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+
+	oidAES128CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// scrypt parameters used for new keys, same as the
+// openssl defaults (N=2^14, r=8, p=1)
+const (
+	scryptN = 1 << 14
+	scryptR = 8
+	scryptP = 1
+)
+
+var errBadPassphrase = errors.New("pkcs8: decryption failed (bad passphrase?)")
+
+type encryptedPrivateKeyInfo struct {
+	Algo          pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+type scryptParams struct {
+	Salt                     []byte
+	CostParameter            int
+	BlockSize                int
+	ParallelizationParameter int
+	KeyLength                int `asn1:"optional"`
+}
+
+// encryptPKCS8 encrypts a DER encoded PKCS#8 private key using
+// PBES2 with scrypt and AES-256-CBC
+func encryptPKCS8(der, pass []byte) ([]byte, error) {
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	key, err := scrypt.Key(pass, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// PKCS#7 padding
+	pad := aes.BlockSize - len(der)%aes.BlockSize
+	data := make([]byte, len(der), len(der)+pad)
+	copy(data, der)
+	for i := 0; i < pad; i++ {
+		data = append(data, byte(pad))
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+
+	kdfParams, err := asn1.Marshal(scryptParams{
+		Salt:                     salt,
+		CostParameter:            scryptN,
+		BlockSize:                scryptR,
+		ParallelizationParameter: scryptP,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{
+			Algorithm:  oidScrypt,
+			Parameters: asn1.RawValue{FullBytes: kdfParams},
+		},
+		EncryptionScheme: pkix.AlgorithmIdentifier{
+			Algorithm:  oidAES256CBC,
+			Parameters: asn1.RawValue{FullBytes: ivParam},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algo: pkix.AlgorithmIdentifier{
+			Algorithm:  oidPBES2,
+			Parameters: asn1.RawValue{FullBytes: params},
+		},
+		EncryptedData: data,
+	})
+}
+
+// decryptPKCS8 decrypts a DER encoded EncryptedPrivateKeyInfo
+// returning the DER encoded PKCS#8 private key
+func decryptPKCS8(der, pass []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("pkcs8: %v", err)
+	}
+	if !info.Algo.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("pkcs8: unsupported encryption algorithm %v", info.Algo.Algorithm)
+	}
+
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algo.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("pkcs8: %v", err)
+	}
+
+	var keyLen int
+	switch alg := params.EncryptionScheme.Algorithm; {
+	case alg.Equal(oidAES128CBC):
+		keyLen = 16
+	case alg.Equal(oidAES192CBC):
+		keyLen = 24
+	case alg.Equal(oidAES256CBC):
+		keyLen = 32
+	default:
+		return nil, fmt.Errorf("pkcs8: unsupported cipher %v", alg)
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, fmt.Errorf("pkcs8: %v", err)
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, errors.New("pkcs8: bad iv length")
+	}
+
+	key, err := deriveKey(params.KeyDerivationFunc, pass, keyLen)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data := info.EncryptedData
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("pkcs8: bad encrypted data length")
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+
+	pad := int(out[len(out)-1])
+	if pad == 0 || pad > aes.BlockSize {
+		return nil, errBadPassphrase
+	}
+	for _, b := range out[len(out)-pad:] {
+		if int(b) != pad {
+			return nil, errBadPassphrase
+		}
+	}
+
+	return out[:len(out)-pad], nil
+}
+
+// deriveKey derives a key of keyLen bytes from pass using
+// the given PBES2 key derivation function
+func deriveKey(kdf pkix.AlgorithmIdentifier, pass []byte, keyLen int) ([]byte, error) {
+	switch {
+	case kdf.Algorithm.Equal(oidScrypt):
+		var p scryptParams
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &p); err != nil {
+			return nil, fmt.Errorf("pkcs8: %v", err)
+		}
+
+		return scrypt.Key(pass, p.Salt, p.CostParameter, p.BlockSize, p.ParallelizationParameter, keyLen)
+	case kdf.Algorithm.Equal(oidPBKDF2):
+		var p pbkdf2Params
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &p); err != nil {
+			return nil, fmt.Errorf("pkcs8: %v", err)
+		}
+
+		var h func() hash.Hash
+		switch prf := p.PRF.Algorithm; {
+		case len(prf) == 0, prf.Equal(oidHMACWithSHA1):
+			h = sha1.New
+		case prf.Equal(oidHMACWithSHA256):
+			h = sha256.New
+		case prf.Equal(oidHMACWithSHA512):
+			h = sha512.New
+		default:
+			return nil, fmt.Errorf("pkcs8: unsupported prf %v", prf)
+		}
+
+		return pbkdf2.Key(pass, p.Salt, p.IterationCount, keyLen, h), nil
+	default:
+		return nil, fmt.Errorf("pkcs8: unsupported key derivation function %v", kdf.Algorithm)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// readList reads a list file with one entry per line.
+// Empty lines and # comments are ignored.
+func readList(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			entries = append(entries, line)
+		}
+	}
+
+	return entries, sc.Err()
+}
@@ -4,7 +4,9 @@ package main
 // version 2020092500, last updated fri sep 25 07:07:02 2020 utc
 // source: https://data.iana.org/TLD/tlds-alpha-by-domain.txt
 
-var nameConstraints = map[string]struct{}{
+const builtinTLDVersion = "version 2020092500, last updated fri sep 25 07:07:02 2020 utc"
+
+var builtinTLDs = map[string]struct{}{
 	"aaa":                      {},
 	"aarp":                     {},
 	"abarth":                   {},
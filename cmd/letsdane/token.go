@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+
+	"github.com/buffrr/letsdane/hsm"
+	"golang.org/x/term"
+)
+
+// loadTokenCA loads the CA certificate for a private key stored in a
+// PKCS#11 token. If the certificate does not exist it is created.
+func loadTokenCA() (*x509.Certificate, crypto.Signer) {
+	uri, err := hsm.ParseURI(*keyPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *certPath == "" {
+		*certPath = path.Join(getConfPath(), "pkcs11.crt")
+	}
+
+	var ca *x509.Certificate
+	var pub crypto.PublicKey
+	if b, err := os.ReadFile(*certPath); err == nil {
+		block, _ := pem.Decode(b)
+		if block == nil {
+			log.Fatalf("%s: no PEM data found", *certPath)
+		}
+		if ca, err = x509.ParseCertificate(block.Bytes); err != nil {
+			log.Fatal(err)
+		}
+		pub = ca.PublicKey
+	}
+
+	signer, err := hsm.Open(uri, tokenPIN(uri), pub)
+	if err == hsm.ErrPKCS11NotAvail {
+		log.Fatal("letsdane has not been compiled with pkcs11 support (build with -tags pkcs11)")
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if ca != nil {
+		if err := checkTokenKey(ca, signer); err != nil {
+			log.Fatalf("%s: %v", *certPath, err)
+		}
+	}
+
+	if ca == nil {
+		ca, err = newAuthority(signer)
+		if err != nil {
+			log.Fatalf("couldn't generate CA: %v", err)
+		}
+
+		if err := os.WriteFile(*certPath, pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: ca.Raw,
+		}), 0644); err != nil {
+			log.Fatalf("couldn't create CA file: %v", err)
+		}
+		log.Printf("Created CA %s for the PKCS#11 key", *certPath)
+	}
+
+	return ca, signer
+}
+
+// checkTokenKey verifies that the token key belongs to the CA certificate
+func checkTokenKey(ca *x509.Certificate, signer crypto.Signer) error {
+	pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok {
+		return fmt.Errorf("unsupported token key type %T", signer.Public())
+	}
+	if !pub.Equal(ca.PublicKey) {
+		return errors.New("certificate does not match the PKCS#11 key")
+	}
+
+	return nil
+}
+
+// tokenPIN returns the token PIN from the uri, DANE_PKCS11_PIN
+// or an interactive prompt
+func tokenPIN(uri *hsm.URI) string {
+	pin, err := uri.PIN()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if pin == "" {
+		pin = os.Getenv("DANE_PKCS11_PIN")
+	}
+	if pin == "" && term.IsTerminal(int(os.Stdin.Fd())) {
+		p, err := readPassword("Enter PIN for the PKCS#11 token: ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		pin = string(p)
+	}
+
+	return pin
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+)
+
+func TestCheckTokenKey(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := newAuthority(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkTokenKey(ca, priv); err != nil {
+		t.Errorf("checkTokenKey(): got %v, want no error", err)
+	}
+
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkTokenKey(ca, other); err == nil {
+		t.Error("checkTokenKey(): got nil, want error for a different key")
+	}
+}
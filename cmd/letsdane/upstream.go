@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/buffrr/letsdane"
+)
+
+// loadUpstreamRoutes reads parent proxy routes with one route per line:
+// comma separated domains (or *.domain wildcards) followed by a proxy
+// url or "direct" e.g. *.onion socks5h://127.0.0.1:9050
+func loadUpstreamRoutes(file string) ([]*letsdane.UpstreamRoute, error) {
+	entries, err := readList(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var routes []*letsdane.UpstreamRoute
+	for _, entry := range entries {
+		fields := strings.Fields(entry)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("bad route %q: want domains followed by a proxy url or direct", entry)
+		}
+
+		route := &letsdane.UpstreamRoute{Domains: strings.Split(fields[0], ",")}
+		if fields[1] != "direct" {
+			if route.URL, err = parseProxyURL(fields[1]); err != nil {
+				return nil, err
+			}
+		}
+		routes = append(routes, route)
+	}
+
+	return routes, nil
+}
+
+func parseProxyURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("bad proxy url %q: want scheme://[user:pass@]host:port", s)
+	}
+
+	return u, nil
+}
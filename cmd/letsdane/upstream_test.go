@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadUpstreamRoutes(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "routes")
+	os.WriteFile(file, []byte("# tor\n*.onion socks5h://127.0.0.1:9050\nintranet.example,*.corp.example direct\n"), 0600)
+
+	routes, err := loadUpstreamRoutes(file)
+	if err != nil {
+		t.Fatalf("loadUpstreamRoutes(): got %v, want no error", err)
+	}
+	if len(routes) != 2 {
+		t.Fatalf("got %d routes, want 2", len(routes))
+	}
+	if routes[0].URL == nil || routes[0].URL.Host != "127.0.0.1:9050" {
+		t.Errorf("got url %v, want socks5h://127.0.0.1:9050", routes[0].URL)
+	}
+	if routes[1].URL != nil || len(routes[1].Domains) != 2 {
+		t.Errorf("got %v %v, want a direct route for two domains", routes[1].Domains, routes[1].URL)
+	}
+
+	for _, bad := range []string{"*.onion", "*.onion 127.0.0.1:9050", "*.onion socks5h://127.0.0.1:9050 extra"} {
+		os.WriteFile(file, []byte(bad), 0600)
+		if _, err := loadUpstreamRoutes(file); err == nil {
+			t.Errorf("loadUpstreamRoutes(%q): got no error", bad)
+		}
+	}
+}
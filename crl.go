@@ -0,0 +1,296 @@
+package letsdane
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CRL reason codes (RFC 5280 section 5.3.1)
+const (
+	reasonUnspecified = 0
+	reasonSuperseded  = 4
+)
+
+// issuedCert is an entry in the inventory of issued certificates
+type issuedCert struct {
+	Serial    string     `json:"serial"`
+	Host      string     `json:"host"`
+	Issuer    string     `json:"issuer"`
+	NotAfter  time.Time  `json:"not_after"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	Reason    int        `json:"reason,omitempty"`
+}
+
+// inventory keeps track of issued certificates so that
+// they can be revoked. If file is set every change is
+// appended to it as a JSON record and the file is
+// compacted when the inventory is loaded.
+type inventory struct {
+	file string
+
+	mu    sync.Mutex
+	certs map[string]*issuedCert
+
+	// filemu serializes appends to file
+	filemu sync.Mutex
+}
+
+// loadInventory creates an inventory backed by file.
+// A missing file results in an empty inventory.
+func loadInventory(file string) (*inventory, error) {
+	inv := &inventory{
+		file:  file,
+		certs: make(map[string]*issuedCert),
+	}
+	if file == "" {
+		return inv, nil
+	}
+
+	f, err := os.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return inv, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	now := time.Now()
+	dec := json.NewDecoder(f)
+	for {
+		var ic issuedCert
+		err := dec.Decode(&ic)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// a truncated last record is left by an interrupted append
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("inventory %s: %v", file, err)
+		}
+		if now.After(ic.NotAfter) {
+			continue
+		}
+		// records for the same serial may be appended out of order
+		if old, ok := inv.certs[ic.Serial]; ok && old.RevokedAt != nil {
+			continue
+		}
+		inv.certs[ic.Serial] = &ic
+	}
+
+	if err := inv.compact(); err != nil {
+		return nil, err
+	}
+
+	return inv, nil
+}
+
+// add records a certificate issued for host by the issuer
+func (i *inventory) add(cert *x509.Certificate, host, issuer string) error {
+	ic := &issuedCert{
+		Serial:   cert.SerialNumber.Text(16),
+		Host:     host,
+		Issuer:   issuer,
+		NotAfter: cert.NotAfter,
+	}
+
+	i.mu.Lock()
+	i.certs[ic.Serial] = ic
+	i.mu.Unlock()
+
+	return i.append([]issuedCert{*ic})
+}
+
+// revoke marks all unexpired certificates issued for host
+// as revoked and returns the number of certificates revoked.
+func (i *inventory) revoke(host string, reason int) (int, error) {
+	i.mu.Lock()
+	now := time.Now()
+	var changed []issuedCert
+	for serial, ic := range i.certs {
+		if now.After(ic.NotAfter) {
+			delete(i.certs, serial)
+			continue
+		}
+		if ic.Host != host || ic.RevokedAt != nil {
+			continue
+		}
+
+		ic.RevokedAt = &now
+		ic.Reason = reason
+		changed = append(changed, *ic)
+	}
+	i.mu.Unlock()
+
+	if len(changed) == 0 {
+		return 0, nil
+	}
+
+	return len(changed), i.append(changed)
+}
+
+// revoked returns the unexpired revoked certificates signed by issuer
+func (i *inventory) revoked(issuer string) []x509.RevocationListEntry {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	now := time.Now()
+	var entries []x509.RevocationListEntry
+	for _, ic := range i.certs {
+		if ic.Issuer != issuer || ic.RevokedAt == nil || now.After(ic.NotAfter) {
+			continue
+		}
+
+		serial, _ := new(big.Int).SetString(ic.Serial, 16)
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   serial,
+			RevocationTime: *ic.RevokedAt,
+			ReasonCode:     ic.Reason,
+		})
+	}
+
+	return entries
+}
+
+// append writes records to the end of the inventory file
+func (i *inventory) append(records []issuedCert) error {
+	if i.file == "" {
+		return nil
+	}
+
+	b, err := encodeRecords(records)
+	if err != nil {
+		return err
+	}
+
+	i.filemu.Lock()
+	defer i.filemu.Unlock()
+
+	f, err := os.OpenFile(i.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// compact rewrites the inventory file with one record
+// per unexpired certificate.
+func (i *inventory) compact() error {
+	i.mu.Lock()
+	records := make([]issuedCert, 0, len(i.certs))
+	for _, ic := range i.certs {
+		records = append(records, *ic)
+	}
+	i.mu.Unlock()
+
+	b, err := encodeRecords(records)
+	if err != nil {
+		return err
+	}
+
+	i.filemu.Lock()
+	defer i.filemu.Unlock()
+
+	tmp := i.file + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, i.file)
+}
+
+// encodeRecords encodes inventory records one per line
+func encodeRecords(records []issuedCert) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, ic := range records {
+		if err := enc.Encode(ic); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// crlPath returns the path at which the CRL for the
+// given authority is served relative to the CRL url
+func crlPath(a *authority) string {
+	return "/" + a.id + ".crl"
+}
+
+// revoke removes cached certificates for host and marks
+// issued ones as revoked.
+func (c *mitmConfig) revoke(host string, reason int) (int, error) {
+	c.certmu.Lock()
+	delete(c.certs, host)
+	c.certmu.Unlock()
+
+	if c.inventory == nil {
+		return 0, nil
+	}
+
+	return c.inventory.revoke(host, reason)
+}
+
+// crl creates a signed CRL of the certificates revoked
+// by the given authority
+func (c *mitmConfig) crl(a *authority) ([]byte, error) {
+	now := time.Now()
+	tmpl := &x509.RevocationList{
+		Number:                    big.NewInt(now.Unix()),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(c.validity),
+		RevokedCertificateEntries: c.inventory.revoked(a.id),
+	}
+
+	return x509.CreateRevocationList(rand.Reader, tmpl, a.cert, a.priv)
+}
+
+// serveCRL serves the CRL of the authority matching
+// the last element of the request path.
+func (c *mitmConfig) serveCRL(w http.ResponseWriter, req *http.Request) {
+	name := path.Base(req.URL.Path)
+
+	var a *authority
+	for _, ca := range []*authority{c.ca, c.next} {
+		if ca != nil && "/"+name == crlPath(ca) {
+			a = ca
+			break
+		}
+	}
+	if a == nil || c.inventory == nil {
+		httpError(w, "CRL not found", http.StatusNotFound)
+		return
+	}
+
+	crl, err := c.crl(a)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(crl)
+}
+
+// crlURL joins the CRL base url and path
+func crlURL(base string, a *authority) string {
+	return strings.TrimSuffix(base, "/") + crlPath(a)
+}
@@ -0,0 +1,129 @@
+package letsdane
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCRL(t *testing.T) {
+	ca, priv, err := NewAuthority("DNSSEC", "DNSSEC", 24*time.Hour, nil)
+	if err != nil {
+		t.Fatalf("NewAuthority(): got %v, want no error", err)
+	}
+
+	c, err := newMITMConfig(ca, priv, time.Hour, "DNSSEC")
+	if err != nil {
+		t.Fatalf("NewConfig(): got %v, want no error", err)
+	}
+
+	file := filepath.Join(t.TempDir(), "issued.json")
+	inv, err := loadInventory(file)
+	if err != nil {
+		t.Fatalf("loadInventory(): got %v, want no error", err)
+	}
+	if err := c.enableCRL("http://127.0.0.1:8080/crl", inv); err != nil {
+		t.Fatalf("c.enableCRL(): got %v, want no error", err)
+	}
+
+	tlsc, err := c.cert("example.com", nil)
+	if err != nil {
+		t.Fatalf("c.cert(%q): got %v, want no error", "example.com", err)
+	}
+	dp := tlsc.Leaf.CRLDistributionPoints
+	if want := "http://127.0.0.1:8080/crl/" + c.ca.id + ".crl"; len(dp) != 1 || dp[0] != want {
+		t.Fatalf("tlsc.Leaf.CRLDistributionPoints: got %v, want [%s]", dp, want)
+	}
+
+	if _, err := c.cert("example.org", nil); err != nil {
+		t.Fatalf("c.cert(%q): got %v, want no error", "example.org", err)
+	}
+
+	n, err := c.revoke("example.com", reasonUnspecified)
+	if err != nil || n != 1 {
+		t.Fatalf("c.revoke(): got %d, %v, want 1, no error", n, err)
+	}
+
+	// revoked certificate must not be served from cache
+	tlsc2, err := c.cert("example.com", nil)
+	if err != nil {
+		t.Fatalf("c.cert(%q): got %v, want no error", "example.com", err)
+	}
+	if tlsc == tlsc2 {
+		t.Fatal("tlsc2: got revoked certificate, want new certificate")
+	}
+
+	// inventory must survive a restart
+	inv, err = loadInventory(file)
+	if err != nil {
+		t.Fatalf("loadInventory(): got %v, want no error", err)
+	}
+	c.inventory = inv
+
+	rec := httptest.NewRecorder()
+	c.serveCRL(rec, httptest.NewRequest(http.MethodGet, "/crl/"+c.ca.id+".crl", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("serveCRL(): got status %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	crl, err := x509.ParseRevocationList(rec.Body.Bytes())
+	if err != nil {
+		t.Fatalf("ParseRevocationList(): got %v, want no error", err)
+	}
+	if err := crl.CheckSignatureFrom(ca); err != nil {
+		t.Fatalf("crl.CheckSignatureFrom(ca): got %v, want no error", err)
+	}
+	if got := len(crl.RevokedCertificateEntries); got != 1 {
+		t.Fatalf("len(crl.RevokedCertificateEntries): got %d, want 1", got)
+	}
+	if got, want := crl.RevokedCertificateEntries[0].SerialNumber, tlsc.Leaf.SerialNumber; got.Cmp(want) != 0 {
+		t.Errorf("revoked serial: got %v, want %v", got, want)
+	}
+
+	rec = httptest.NewRecorder()
+	c.serveCRL(rec, httptest.NewRequest(http.MethodGet, "/crl/unknown.crl", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("serveCRL(): got status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestLoadInventory(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "issued.json")
+	notAfter := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	revokedAt := time.Now().UTC().Format(time.RFC3339)
+
+	// the revocation of 0a was appended before its issue record,
+	// 0c has expired and the last record was cut short
+	records := `{"serial":"0a","host":"example.com","issuer":"ca","not_after":"` + notAfter + `","revoked_at":"` + revokedAt + `","reason":4}
+{"serial":"0a","host":"example.com","issuer":"ca","not_after":"` + notAfter + `"}
+{"serial":"0b","host":"example.org","issuer":"ca","not_after":"` + notAfter + `"}
+{"serial":"0c","host":"example.net","issuer":"ca","not_after":"2000-01-01T00:00:00Z"}
+{"serial":"0d","host":`
+	if err := os.WriteFile(file, []byte(records), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	inv, err := loadInventory(file)
+	if err != nil {
+		t.Fatalf("loadInventory(): got %v, want no error", err)
+	}
+	if got := len(inv.certs); got != 2 {
+		t.Fatalf("len(inv.certs): got %d, want 2", got)
+	}
+	if got := inv.revoked("ca"); len(got) != 1 || got[0].ReasonCode != reasonSuperseded {
+		t.Fatalf("inv.revoked(): got %v, want 1 superseded entry", got)
+	}
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(string(b), "\n"); got != 2 {
+		t.Errorf("compacted inventory: got %d records, want 2", got)
+	}
+}
@@ -9,7 +9,6 @@ import (
 	"github.com/buffrr/letsdane/resolver"
 	"github.com/miekg/dns"
 	"net"
-	"net/http"
 	"time"
 )
 
@@ -19,6 +18,9 @@ type dialer struct {
 	heConfig  *happyeyeballs.Config
 	heDialer  *happyeyeballs.Dialer
 	heMetrics *happyeyeballs.Metrics
+
+	// upstreams if set routes connections through parent proxies
+	upstreams *upstreams
 }
 
 var errBadHost = errors.New("bad host")
@@ -27,6 +29,14 @@ type addrList struct {
 	Host string
 	Port string
 	IPs  []net.IP
+
+	// TLSAName is the name TLSA records were looked up for. It is
+	// the host or, for ip literals, a name from a secure PTR record.
+	TLSAName string
+
+	// DNSSEC status of the address and TLSA lookups
+	Secure     bool
+	TLSASecure bool
 }
 
 func newDialer() *dialer {
@@ -68,6 +78,18 @@ func newDialer() *dialer {
 // dialTLSContext attempts to connect to one of the dst addresses and initiates a TLS
 // handshake, returning the resulting TLS connection.
 func (d *dialer) dialTLSContext(ctx context.Context, network string, dst *addrList, config *tls.Config) (*tls.Conn, error) {
+	if conn, ok, err := d.dialUpstream(ctx, network, dst); ok {
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+
 	if d.heConfig != nil && d.heConfig.Enabled && d.heDialer != nil && len(dst.IPs) > 0 {
 		conn, err := d.heDialer.DialTLSHappyEyeballs(ctx, network, dst.Host, dst.Port, dst.IPs, config)
 		if err == nil {
@@ -110,6 +132,10 @@ func (d *dialer) dialContext(ctx context.Context, network, addr string) (net.Con
 
 // dialAddrList attempts to connect to one of the dst addresses
 func (d *dialer) dialAddrList(ctx context.Context, network string, dst *addrList) (net.Conn, error) {
+	if conn, ok, err := d.dialUpstream(ctx, network, dst); ok {
+		return conn, err
+	}
+
 	if d.heConfig != nil && d.heConfig.Enabled && d.heDialer != nil && len(dst.IPs) > 0 {
 		conn, err := d.heDialer.DialHappyEyeballs(ctx, network, dst.Host, dst.Port, dst.IPs)
 		if err == nil {
@@ -137,14 +163,18 @@ func (d *dialer) resolveAddr(ctx context.Context, addr string) (addrs *addrList,
 	if err != nil {
 		return
 	}
+	if d.routed(addrs.Host) {
+		// resolved by the parent proxy
+		return
+	}
 
 	if d.heConfig != nil && d.heConfig.Enabled && d.heMetrics != nil {
 		lookupFunc := func(ctx context.Context, network, host string) ([]net.IP, bool, error) {
 			return d.resolver.LookupIP(ctx, network, host)
 		}
-		addrs.IPs, _, err = happyeyeballs.ConcurrentDNSLookup(ctx, addrs.Host, lookupFunc, d.heConfig.ResolutionDelay, d.heMetrics)
+		addrs.IPs, addrs.Secure, err = happyeyeballs.ConcurrentDNSLookup(ctx, addrs.Host, lookupFunc, d.heConfig.ResolutionDelay, d.heMetrics)
 	} else {
-		addrs.IPs, _, err = d.resolver.LookupIP(ctx, "ip", addrs.Host)
+		addrs.IPs, addrs.Secure, err = d.resolver.LookupIP(ctx, "ip", addrs.Host)
 	}
 
 	if err != nil {
@@ -160,15 +190,22 @@ func (d *dialer) resolveAddr(ctx context.Context, addr string) (addrs *addrList,
 
 // resolveDANE resolves the given host by performing a dns lookup returning
 // an address list of ipv4 and ipv6 addresses and TLSA resource records.
-func (d *dialer) resolveDANE(ctx context.Context, network, host string, constraints map[string]struct{}) (addrs *addrList, tlsa []*dns.TLSA, err error) {
+func (d *dialer) resolveDANE(ctx context.Context, network, host string, constraints, permitted map[string]struct{}) (addrs *addrList, tlsa []*dns.TLSA, err error) {
 	addrs = &addrList{}
 	tlsa = []*dns.TLSA{}
 	addrs.Host, addrs.Port, err = net.SplitHostPort(host)
 	if err != nil || addrs.Host == "" || addrs.Port == "" {
 		return nil, nil, errBadHost
 	}
+	addrs.TLSAName = addrs.Host
 	if ip := net.ParseIP(addrs.Host); ip != nil {
 		addrs.IPs = []net.IP{ip}
+		tlsa, err = d.resolvePTRDANE(ctx, network, addrs, ip, constraints, permitted)
+		return
+	}
+
+	if d.routed(addrs.Host) {
+		// resolved by the parent proxy
 		return
 	}
 
@@ -176,21 +213,20 @@ func (d *dialer) resolveDANE(ctx context.Context, network, host string, constrai
 	var tlsaErr, ipErr error
 
 	go func() {
+		defer func() { done <- struct{}{} }()
 		if d.heConfig != nil && d.heConfig.Enabled && d.heMetrics != nil {
 			lookupFunc := func(ctx context.Context, network, host string) ([]net.IP, bool, error) {
 				return d.resolver.LookupIP(ctx, network, host)
 			}
-			addrs.IPs, _, ipErr = happyeyeballs.ConcurrentDNSLookup(ctx, addrs.Host, lookupFunc, d.heConfig.ResolutionDelay, d.heMetrics)
+			addrs.IPs, addrs.Secure, ipErr = happyeyeballs.ConcurrentDNSLookup(ctx, addrs.Host, lookupFunc, d.heConfig.ResolutionDelay, d.heMetrics)
 		} else {
-			addrs.IPs, _, ipErr = d.resolver.LookupIP(ctx, "ip", addrs.Host)
+			addrs.IPs, addrs.Secure, ipErr = d.resolver.LookupIP(ctx, "ip", addrs.Host)
 		}
-		done <- struct{}{}
 	}()
 
-	if constraints == nil || !inConstraints(constraints, addrs.Host) {
-		var secure bool
-		tlsa, secure, tlsaErr = d.resolver.LookupTLSA(ctx, addrs.Port, network, addrs.Host)
-		if !secure {
+	if !inConstraints(constraints, addrs.Host) && inPermitted(permitted, addrs.Host) {
+		tlsa, addrs.TLSASecure, tlsaErr = d.resolver.LookupTLSA(ctx, addrs.Port, network, addrs.Host)
+		if !addrs.TLSASecure {
 			tlsa = []*dns.TLSA{}
 		}
 	}
@@ -205,16 +241,36 @@ func (d *dialer) resolveDANE(ctx context.Context, network, host string, constrai
 	return
 }
 
-// httpOnlyRoundTripper creates a round tripper used for http requests (fails on https requests)
-func httpOnlyRoundTripper(d *dialer) http.RoundTripper {
-	return &http.Transport{
-		DialContext: func(ctx context.Context, network, addr string) (conn net.Conn, err error) {
-			return d.dialContext(ctx, network, addr)
-		},
-		DialTLSContext: func(ctx context.Context, network, address string) (net.Conn, error) {
-			return nil, fmt.Errorf("dial tls for host %s not supported", address)
-		},
+// resolvePTRDANE looks up TLSA records for an ip literal using the names
+// from its PTR records. Both the PTR and TLSA lookups must be secure. Lookup
+// failures are not errors since ip literals are tunneled without DANE.
+func (d *dialer) resolvePTRDANE(ctx context.Context, network string, addrs *addrList, ip net.IP, constraints, permitted map[string]struct{}) ([]*dns.TLSA, error) {
+	r, ok := d.resolver.(resolver.PTRResolver)
+	if !ok {
+		return []*dns.TLSA{}, nil
 	}
+
+	names, secure, err := r.LookupPTR(ctx, ip)
+	if err != nil || !secure {
+		return []*dns.TLSA{}, nil
+	}
+
+	for _, name := range names {
+		if _, ok := dns.IsDomainName(name); !ok || inConstraints(constraints, name) || !inPermitted(permitted, name) {
+			continue
+		}
+
+		tlsa, secure, err := d.resolver.LookupTLSA(ctx, addrs.Port, network, name)
+		if err != nil || !secure || len(tlsa) == 0 {
+			continue
+		}
+
+		addrs.TLSAName = name
+		addrs.TLSASecure = true
+		return tlsa, nil
+	}
+
+	return []*dns.TLSA{}, nil
 }
 
 // tlsaSupported checks if there is a supported DANE usage
@@ -7,8 +7,11 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
+
+	"github.com/buffrr/letsdane/proxy"
 )
 
 func TestDialTLS(t *testing.T) {
@@ -52,3 +55,70 @@ func TestDialTLS(t *testing.T) {
 		t.Fatalf("body = '%s', wanted 'foo'", c)
 	}
 }
+
+func TestDialUpstream(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		wr.Write([]byte("foo"))
+	}))
+	defer srv.Close()
+
+	// parent proxy reaching any destination at srv
+	var gotAddr string
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go (&proxy.SOCKSServer{
+		Tunneler: proxy.TunnelerFunc(func(ctx context.Context, clientConn *proxy.Conn, network, addr string) {
+			defer clientConn.Close()
+			gotAddr = addr
+			remote, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				clientConn.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			clientConn.WriteHeader(http.StatusOK)
+			clientConn.Copy(remote)
+		}),
+	}).Serve(l)
+
+	d := newDialer()
+	d.upstreams, err = newUpstreams(nil, []*UpstreamRoute{
+		{Domains: []string{"direct.onion"}},
+		{Domains: []string{"*.onion"}, URL: &url.URL{Scheme: "socks5h", Host: l.Addr().String()}},
+		{Domains: []string{"*.lan"}, URL: &url.URL{Scheme: "socks5", Host: l.Addr().String()}},
+	}, d.net.DialContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.routed("example.com") || d.routed("direct.onion") || !d.routed("www.example.onion") || d.routed("host.lan") {
+		t.Fatal("routes don't match")
+	}
+
+	// no local lookups that would leak the name
+	addrs, tlsa, err := d.resolveDANE(context.Background(), "tcp", "www.example.onion:443", nil, nil)
+	if err != nil || len(addrs.IPs) != 0 || len(tlsa) != 0 {
+		t.Fatalf("resolveDANE(): got %v %v %v, want no lookups", addrs.IPs, tlsa, err)
+	}
+
+	// no addresses since the name is resolved by the parent
+	addrs = &addrList{Host: "www.example.onion", Port: "443"}
+	tlsa = newTLSA(3, 1, 1, srv.Certificate())
+	conn, err := d.dialTLSContext(context.Background(), "tcp", addrs, newTLSConfig("", tlsa, false))
+	if err != nil {
+		t.Fatalf("dialTLSContext(): got %v, want no error", err)
+	}
+	defer conn.Close()
+	if gotAddr != "www.example.onion:443" {
+		t.Fatalf("parent got %s, want www.example.onion:443", gotAddr)
+	}
+
+	// dane is still validated locally
+	conn.Close()
+	tlsa[0].Certificate = strings.Repeat("00", 32)
+	if _, err := d.dialTLSContext(context.Background(), "tcp", addrs, newTLSConfig("", tlsa, false)); err == nil {
+		t.Fatal("got no error for a mismatched tlsa record")
+	}
+}
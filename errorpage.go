@@ -0,0 +1,181 @@
+package letsdane
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// validationFailure describes why the remote of
+// a tunnel could not be authenticated
+type validationFailure struct {
+	Host  string `json:"host"`
+	Port  string `json:"port"`
+	Error string `json:"error"`
+
+	// TLSA records found and whether the lookups were DNSSEC secure
+	TLSA          []string `json:"tlsa"`
+	TLSASecure    bool     `json:"tlsa_secure"`
+	AddressSecure bool     `json:"address_secure"`
+
+	// Fingerprints of the certificate presented by the remote
+	CertSHA256 string `json:"cert_sha256,omitempty"`
+	SPKISHA256 string `json:"spki_sha256,omitempty"`
+
+	// OverrideURL and OverrideToken allow the user to
+	// proceed anyway if overrides are enabled
+	OverrideURL   string `json:"override_url,omitempty"`
+	OverrideToken string `json:"override_token,omitempty"`
+}
+
+func newValidationFailure(addrs *addrList, tlsa []*dns.TLSA, err *tlsError) *validationFailure {
+	f := &validationFailure{
+		Host:          addrs.Host,
+		Port:          addrs.Port,
+		Error:         err.Error(),
+		TLSA:          []string{},
+		TLSASecure:    addrs.TLSASecure,
+		AddressSecure: addrs.Secure,
+	}
+
+	for _, rr := range tlsa {
+		f.TLSA = append(f.TLSA, fmt.Sprintf("%d %d %d %s", rr.Usage, rr.Selector, rr.MatchingType, rr.Certificate))
+	}
+
+	if err.cert != nil {
+		h := sha256.Sum256(err.cert.Raw)
+		f.CertSHA256 = hex.EncodeToString(h[:])
+		h = sha256.Sum256(err.cert.RawSubjectPublicKeyInfo)
+		f.SPKISHA256 = hex.EncodeToString(h[:])
+	}
+
+	return f
+}
+
+// ServeHTTP serves the failure as an html page or
+// as json if requested by the client
+func (f *validationFailure) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	code := http.StatusBadGateway
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	if strings.Contains(req.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(f)
+		return
+	}
+
+	secure := func(b bool) string {
+		if b {
+			return "secure"
+		}
+		return "insecure"
+	}
+
+	var form string
+	if f.OverrideToken != "" {
+		form = fmt.Sprintf("<form method=\"post\" action=\"%s\">"+
+			"<input type=\"hidden\" name=\"host\" value=\"%s\"><input type=\"hidden\" name=\"port\" value=\"%s\">"+
+			"<input type=\"hidden\" name=\"cert\" value=\"%s\"><input type=\"hidden\" name=\"token\" value=\"%s\">"+
+			"Trust this certificate for <select name=\"hours\"><option>1</option><option>8</option><option>24</option></select> hours "+
+			"<button type=\"submit\">Proceed anyway</button></form>",
+			html.EscapeString(f.OverrideURL), html.EscapeString(f.Host), html.EscapeString(f.Port), f.CertSHA256, f.OverrideToken)
+	}
+
+	var sb strings.Builder
+	if len(f.TLSA) == 0 {
+		sb.WriteString("<p>No TLSA records found.</p>")
+	} else {
+		sb.WriteString("<ul>")
+		for _, rr := range f.TLSA {
+			fmt.Fprintf(&sb, "<li><code>%s</code></li>", html.EscapeString(rr))
+		}
+		sb.WriteString("</ul>")
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "<h1>%d %s</h1><p>letsdane could not authenticate %s: %s</p>"+
+		"<h2>TLSA records for _%s._tcp.%s (DNSSEC %s)</h2>%s"+
+		"<h2>Presented certificate</h2><p>SHA-256: <code>%s</code><br>SPKI SHA-256: <code>%s</code></p>"+
+		"<p>Address lookup: DNSSEC %s</p>%s<hr>letsdane/v%s",
+		code, http.StatusText(code), html.EscapeString(f.Host), html.EscapeString(f.Error),
+		html.EscapeString(f.Port), html.EscapeString(f.Host), secure(f.TLSASecure), sb.String(),
+		f.CertSHA256, f.SPKISHA256, secure(f.AddressSecure), form, Version)
+}
+
+// serveErrorPage completes the client handshake with a certificate
+// issued by the proxy and serves the validation failure.
+func (h *tunneler) serveErrorPage(clientConn net.Conn, hello *tls.ClientHelloInfo, addr string, f *validationFailure) {
+	config := h.mitm.configForTLSADomain(f.Host, nil)
+	config.NextProtos = nil
+	for _, proto := range hello.SupportedProtos {
+		if proto == "http/1.1" {
+			config.NextProtos = []string{proto}
+		}
+	}
+
+	clientTLS := tls.Server(clientConn, config)
+	if err := clientTLS.Handshake(); err != nil {
+		h.warnf("error page: client handshake failed: %v", statusErr, addr, err)
+		return
+	}
+
+	serveFailure(clientTLS, f)
+}
+
+// serveFailure serves the validation failure on
+// an established client connection
+func serveFailure(conn net.Conn, f *validationFailure) {
+	done := make(chan struct{})
+	srv := &http.Server{
+		Handler:      f,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		ConnState: func(c net.Conn, state http.ConnState) {
+			if state == http.StateClosed {
+				close(done)
+			}
+		},
+	}
+	srv.SetKeepAlivesEnabled(false)
+	srv.Serve(&singleConnListener{conn: conn})
+	<-done
+}
+
+// singleConnListener is a net.Listener accepting a single connection
+type singleConnListener struct {
+	conn net.Conn
+	once sync.Once
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	var c net.Conn
+	l.once.Do(func() {
+		c = l.conn
+	})
+	if c == nil {
+		return nil, net.ErrClosed
+	}
+
+	return c, nil
+}
+
+func (l *singleConnListener) Close() error {
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
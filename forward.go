@@ -0,0 +1,148 @@
+package letsdane
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+)
+
+// dnssecStatusHeader is the response header reporting the DNSSEC
+// status of the addresses a forwarded request was sent to
+const dnssecStatusHeader = "X-DNSSEC-Status"
+
+var errDNSSECRequired = errors.New("dnssec validation required")
+
+// Upgrade modes for plain http requests to hosts with DANE
+const (
+	UpgradeNone = iota
+	// UpgradeRedirect redirects the client to the https url
+	UpgradeRedirect
+	// UpgradeFetch fetches the https url on behalf of the client
+	UpgradeFetch
+)
+
+// forwardRoundTripper creates the round tripper used for absolute
+// http and https urls sent to the proxy without CONNECT. https urls
+// are fetched by the proxy validating the remote with DANE if it
+// has TLSA records and the PKIX roots otherwise.
+func forwardRoundTripper(h *tunneler) http.RoundTripper {
+	return &http.Transport{
+		DialContext:    h.dialForward,
+		DialTLSContext: h.dialForwardTLS,
+	}
+}
+
+// dnssecConn is a forward connection remembering the
+// DNSSEC status of the addresses it was dialed to
+type dnssecConn struct {
+	net.Conn
+	status string
+}
+
+// dnssecStatus describes the DNSSEC status of addrs: secure, insecure
+// or none for ip literals. Names resolved by a parent proxy are insecure.
+func dnssecStatus(addrs *addrList) string {
+	if net.ParseIP(addrs.Host) != nil {
+		return "none"
+	}
+	if addrs.Secure {
+		return "secure"
+	}
+	return "insecure"
+}
+
+// withDNSSECStatus returns req with a client trace setting the
+// DNSSEC status header of rw once a connection is obtained
+func withDNSSECStatus(rw http.ResponseWriter, req *http.Request) *http.Request {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if conn, ok := info.Conn.(*dnssecConn); ok {
+				rw.Header().Set(dnssecStatusHeader, conn.status)
+			}
+		},
+	}
+
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// dialForward connects to addr for a plain http url
+// refusing insecure names if DNSSEC is required
+func (h *tunneler) dialForward(ctx context.Context, network, addr string) (net.Conn, error) {
+	addrs, err := h.dialer.resolveAddr(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	status := dnssecStatus(addrs)
+	if h.requireDNSSEC && status == "insecure" {
+		return nil, fmt.Errorf("%w: addresses of %s are insecure", errDNSSECRequired, addrs.Host)
+	}
+
+	conn, err := h.dialer.dialAddrList(ctx, network, addrs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dnssecConn{Conn: conn, status: status}, nil
+}
+
+// dialForwardTLS connects to addr for an https url applying
+// the same DANE policy as tunnels
+func (h *tunneler) dialForwardTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	addrs, tlsa, err := h.dialer.resolveDANE(ctx, network, addr, h.constraints, h.permitted)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs.IPs) == 0 && !h.dialer.routed(addrs.Host) {
+		return nil, fmt.Errorf("%s no such host", addrs.Host)
+	}
+
+	if !tlsaSupported(tlsa) {
+		h.revoke(addr, addrs.Host)
+		if required := h.daneRequired(addrs); required != "" {
+			return nil, errors.New(required + ", no secure tlsa records found")
+		}
+
+		conn, err := h.dialer.dialTLSContext(ctx, network, addrs, newPKIXConfig(addrs.Host, h.pkixRoots))
+		if err != nil {
+			return nil, err
+		}
+		return &dnssecConn{Conn: conn, status: dnssecStatus(addrs)}, nil
+	}
+
+	conn, err := h.dialer.dialTLSContext(ctx, network, addrs, newTLSConfig(addrs.TLSAName, tlsa, h.nameChecks))
+	if err != nil {
+		if _, ok := err.(*tlsError); ok {
+			h.revoke(addr, addrs.Host)
+		}
+		return nil, err
+	}
+	if err := h.pins.add(addrs.Host, addrs.Port); err != nil {
+		h.warnf("pin: %v", statusErr, addr, err)
+	}
+
+	return &dnssecConn{Conn: conn, status: dnssecStatus(addrs)}, nil
+}
+
+// daneUpgrade checks if a plain http request to req's host
+// can be upgraded to https because the host has secure TLSA
+// records for port 443. Requests to other ports aren't upgraded.
+func (h *tunneler) daneUpgrade(req *http.Request) bool {
+	if req.URL.Scheme != "http" {
+		return false
+	}
+	host, port := req.URL.Hostname(), req.URL.Port()
+	if port != "" && port != "80" {
+		return false
+	}
+	if net.ParseIP(host) != nil || inConstraints(h.constraints, host) || !inPermitted(h.permitted, host) ||
+		h.dialer.routed(host) {
+		return false
+	}
+
+	tlsa, secure, err := h.dialer.resolver.LookupTLSA(req.Context(), "443", "tcp", host)
+	return err == nil && secure && tlsaSupported(tlsa)
+}
@@ -1,16 +1,20 @@
 module github.com/buffrr/letsdane
 
-go 1.21
+go 1.24
 
 require (
 	github.com/buffrr/hsig0 v0.0.0-20200928223456-eca10c3b5481
 	github.com/miekg/dns v1.1.31
+	github.com/miekg/pkcs11 v1.1.1
 	github.com/miekg/unbound v0.0.0-20180419064740-e2b53b2dbcba
+	golang.org/x/crypto v0.11.0
+	golang.org/x/net v0.10.0
+	golang.org/x/term v0.10.0
+	software.sslmate.com/src/go-pkcs12 v0.5.0
 )
 
 require (
 	github.com/decred/dcrd/dcrec/secp256k1/v3 v3.0.0 // indirect
-	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a // indirect
-	golang.org/x/net v0.0.0-20190923162816-aa69164e4478 // indirect
-	golang.org/x/sys v0.0.0-20190924154521-2837fb4f24fe // indirect
+	golang.org/x/sys v0.10.0 // indirect
+	golang.org/x/text v0.11.0 // indirect
 )
@@ -0,0 +1,105 @@
+package hsm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+var (
+	oidNamedCurveP256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+	oidNamedCurveP384 = asn1.ObjectIdentifier{1, 3, 132, 0, 34}
+	oidNamedCurveP521 = asn1.ObjectIdentifier{1, 3, 132, 0, 35}
+)
+
+// digestInfoPrefix are the DER encoded DigestInfo prefixes
+// required by CKM_RSA_PKCS which signs the raw DigestInfo (RFC 8017)
+var digestInfoPrefix = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA224: {0x30, 0x2d, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x04, 0x05, 0x00, 0x04, 0x1c},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// digestInfo returns the DigestInfo for the given digest
+func digestInfo(h crypto.Hash, digest []byte) ([]byte, error) {
+	prefix, ok := digestInfoPrefix[h]
+	if !ok {
+		return nil, fmt.Errorf("pkcs11: unsupported hash %v", h)
+	}
+	if len(digest) != h.Size() {
+		return nil, errors.New("pkcs11: digest length does not match hash")
+	}
+
+	return append(append([]byte{}, prefix...), digest...), nil
+}
+
+// ecdsaSignature converts a raw r||s signature as returned by
+// CKM_ECDSA to the ASN.1 encoding used by crypto/ecdsa
+func ecdsaSignature(raw []byte) ([]byte, error) {
+	if len(raw) == 0 || len(raw)%2 != 0 {
+		return nil, errors.New("pkcs11: bad ecdsa signature length")
+	}
+
+	n := len(raw) / 2
+	return asn1.Marshal(struct {
+		R, S *big.Int
+	}{
+		new(big.Int).SetBytes(raw[:n]),
+		new(big.Int).SetBytes(raw[n:]),
+	})
+}
+
+// rsaPublicKey creates a public key from the CKA_MODULUS
+// and CKA_PUBLIC_EXPONENT attributes
+func rsaPublicKey(modulus, exponent []byte) (*rsa.PublicKey, error) {
+	e := new(big.Int).SetBytes(exponent)
+	if !e.IsInt64() || e.Int64() > 1<<31-1 {
+		return nil, errors.New("pkcs11: bad rsa public exponent")
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(modulus),
+		E: int(e.Int64()),
+	}, nil
+}
+
+// ecPublicKey creates a public key from the CKA_EC_PARAMS
+// and CKA_EC_POINT attributes
+func ecPublicKey(params, point []byte) (*ecdsa.PublicKey, error) {
+	var oid asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(params, &oid); err != nil {
+		return nil, fmt.Errorf("pkcs11: bad ec params: %v", err)
+	}
+
+	var curve elliptic.Curve
+	switch {
+	case oid.Equal(oidNamedCurveP256):
+		curve = elliptic.P256()
+	case oid.Equal(oidNamedCurveP384):
+		curve = elliptic.P384()
+	case oid.Equal(oidNamedCurveP521):
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("pkcs11: unsupported curve %v", oid)
+	}
+
+	// CKA_EC_POINT is a DER encoded OCTET STRING
+	var raw []byte
+	if _, err := asn1.Unmarshal(point, &raw); err != nil {
+		raw = point
+	}
+
+	x, y := elliptic.Unmarshal(curve, raw)
+	if x == nil {
+		return nil, errors.New("pkcs11: bad ec point")
+	}
+
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
@@ -0,0 +1,335 @@
+//go:build pkcs11
+// +build pkcs11
+
+package hsm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// Signer is a crypto.Signer backed by a private key
+// in a PKCS#11 token. The token session is reopened
+// if it is closed or the token was reconnected.
+type Signer struct {
+	uri *URI
+	pin string
+	pub crypto.PublicKey
+	ctx *pkcs11.Ctx
+
+	mu      sync.Mutex
+	open    bool
+	session pkcs11.SessionHandle
+	key     pkcs11.ObjectHandle
+}
+
+// Open loads the PKCS#11 module and logs into the token identified
+// by uri. If pub is nil the public key is read from the token.
+func Open(uri *URI, pin string, pub crypto.PublicKey) (*Signer, error) {
+	ctx := pkcs11.New(uri.ModulePath)
+	if ctx == nil {
+		return nil, fmt.Errorf("pkcs11: couldn't load module %s", uri.ModulePath)
+	}
+	if err := ctx.Initialize(); err != nil && err != pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		ctx.Destroy()
+		return nil, fmt.Errorf("pkcs11: initialize: %v", err)
+	}
+
+	s := &Signer{
+		uri: uri,
+		pin: pin,
+		pub: pub,
+		ctx: ctx,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.connect(); err != nil {
+		ctx.Finalize()
+		ctx.Destroy()
+		return nil, err
+	}
+	if s.pub == nil {
+		var err error
+		if s.pub, err = s.publicKey(); err != nil {
+			s.closeSession()
+			ctx.Finalize()
+			ctx.Destroy()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Public returns the public key of the signer
+func (s *Signer) Public() crypto.PublicKey {
+	return s.pub
+}
+
+// Sign signs digest with the private key in the token.
+func (s *Signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	mech, data, err := s.mechanism(digest, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var sig []byte
+	if s.open {
+		sig, err = s.sign(mech, data)
+	}
+	if !s.open || sessionLost(err) {
+		// session dropped (token removed, module restarted ...)
+		s.closeSession()
+		if err = s.connect(); err == nil {
+			sig, err = s.sign(mech, data)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11: sign: %v", err)
+	}
+
+	if _, ok := s.pub.(*ecdsa.PublicKey); ok {
+		return ecdsaSignature(sig)
+	}
+	return sig, nil
+}
+
+// Close logs out of the token and unloads the module
+func (s *Signer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closeSession()
+	err := s.ctx.Finalize()
+	s.ctx.Destroy()
+	return err
+}
+
+// mechanism returns the signing mechanism and data to sign
+// for the given digest and key type
+func (s *Signer) mechanism(digest []byte, opts crypto.SignerOpts) (*pkcs11.Mechanism, []byte, error) {
+	switch s.pub.(type) {
+	case *rsa.PublicKey:
+		if pss, ok := opts.(*rsa.PSSOptions); ok {
+			hashMech, mgf, err := pssHash(pss.Hash)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			saltLen := pss.SaltLength
+			if saltLen == rsa.PSSSaltLengthEqualsHash || saltLen == rsa.PSSSaltLengthAuto {
+				saltLen = pss.Hash.Size()
+			}
+
+			params := pkcs11.NewPSSParams(hashMech, mgf, uint(saltLen))
+			return pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS, params), digest, nil
+		}
+
+		data, err := digestInfo(opts.HashFunc(), digest)
+		if err != nil {
+			return nil, nil, err
+		}
+		return pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil), data, nil
+	case *ecdsa.PublicKey:
+		return pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil), digest, nil
+	default:
+		return nil, nil, fmt.Errorf("pkcs11: unsupported key type %T", s.pub)
+	}
+}
+
+func pssHash(h crypto.Hash) (hashMech, mgf uint, err error) {
+	switch h {
+	case crypto.SHA256:
+		return pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256, nil
+	case crypto.SHA384:
+		return pkcs11.CKM_SHA384, pkcs11.CKG_MGF1_SHA384, nil
+	case crypto.SHA512:
+		return pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512, nil
+	}
+
+	return 0, 0, fmt.Errorf("pkcs11: unsupported hash %v", h)
+}
+
+// sign must be called with s.mu held
+func (s *Signer) sign(mech *pkcs11.Mechanism, data []byte) ([]byte, error) {
+	if err := s.ctx.SignInit(s.session, []*pkcs11.Mechanism{mech}, s.key); err != nil {
+		return nil, err
+	}
+
+	return s.ctx.Sign(s.session, data)
+}
+
+// connect opens a session, logs in and finds the private key.
+// It must be called with s.mu held.
+func (s *Signer) connect() error {
+	slot, err := s.findSlot()
+	if err != nil {
+		return err
+	}
+
+	session, err := s.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return fmt.Errorf("pkcs11: open session: %v", err)
+	}
+
+	if err := s.ctx.Login(session, pkcs11.CKU_USER, s.pin); err != nil &&
+		err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+		s.ctx.CloseSession(session)
+		return fmt.Errorf("pkcs11: login: %v", err)
+	}
+
+	key, err := s.findObject(session, pkcs11.CKO_PRIVATE_KEY)
+	if err != nil {
+		s.ctx.Logout(session)
+		s.ctx.CloseSession(session)
+		return err
+	}
+
+	s.session = session
+	s.key = key
+	s.open = true
+	return nil
+}
+
+// closeSession must be called with s.mu held
+func (s *Signer) closeSession() {
+	if !s.open {
+		return
+	}
+
+	s.ctx.Logout(s.session)
+	s.ctx.CloseSession(s.session)
+	s.open = false
+}
+
+// findSlot returns the first slot with a token matching the uri
+func (s *Signer) findSlot() (uint, error) {
+	slots, err := s.ctx.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("pkcs11: get slot list: %v", err)
+	}
+
+	for _, slot := range slots {
+		if s.uri.SlotID != nil && *s.uri.SlotID != slot {
+			continue
+		}
+
+		info, err := s.ctx.GetTokenInfo(slot)
+		if err != nil {
+			continue
+		}
+		if s.uri.Token != "" && s.uri.Token != info.Label {
+			continue
+		}
+		if s.uri.Serial != "" && s.uri.Serial != info.SerialNumber {
+			continue
+		}
+
+		return slot, nil
+	}
+
+	return 0, errors.New("pkcs11: no matching token found")
+}
+
+// findObject returns the object of the given class matching the uri
+func (s *Signer) findObject(session pkcs11.SessionHandle, class uint) (pkcs11.ObjectHandle, error) {
+	tmpl := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+	}
+	if s.uri.Object != "" {
+		tmpl = append(tmpl, pkcs11.NewAttribute(pkcs11.CKA_LABEL, s.uri.Object))
+	}
+	if s.uri.ID != nil {
+		tmpl = append(tmpl, pkcs11.NewAttribute(pkcs11.CKA_ID, s.uri.ID))
+	}
+
+	if err := s.ctx.FindObjectsInit(session, tmpl); err != nil {
+		return 0, fmt.Errorf("pkcs11: find objects: %v", err)
+	}
+	defer s.ctx.FindObjectsFinal(session)
+
+	objs, _, err := s.ctx.FindObjects(session, 2)
+	if err != nil {
+		return 0, fmt.Errorf("pkcs11: find objects: %v", err)
+	}
+	switch len(objs) {
+	case 0:
+		return 0, errors.New("pkcs11: no matching key found")
+	case 1:
+		return objs[0], nil
+	default:
+		return 0, errors.New("pkcs11: uri matches more than one key")
+	}
+}
+
+// publicKey reads the public key matching the uri from the token.
+// It must be called with s.mu held.
+func (s *Signer) publicKey() (crypto.PublicKey, error) {
+	obj, err := s.findObject(s.session, pkcs11.CKO_PUBLIC_KEY)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs, err := s.ctx.GetAttributeValue(s.session, obj, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11: read public key: %v", err)
+	}
+
+	// CK_ULONG in native (little endian) byte order
+	var keyType uint
+	for i, b := range attrs[0].Value {
+		keyType |= uint(b) << (8 * i)
+	}
+
+	switch keyType {
+	case pkcs11.CKK_RSA:
+		attrs, err := s.ctx.GetAttributeValue(s.session, obj, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("pkcs11: read public key: %v", err)
+		}
+		return rsaPublicKey(attrs[0].Value, attrs[1].Value)
+	case pkcs11.CKK_EC:
+		attrs, err := s.ctx.GetAttributeValue(s.session, obj, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("pkcs11: read public key: %v", err)
+		}
+		return ecPublicKey(attrs[0].Value, attrs[1].Value)
+	default:
+		return nil, fmt.Errorf("pkcs11: unsupported key type %d", keyType)
+	}
+}
+
+// sessionLost checks if err indicates that the session
+// must be reopened
+func sessionLost(err error) bool {
+	switch err {
+	case pkcs11.Error(pkcs11.CKR_SESSION_HANDLE_INVALID),
+		pkcs11.Error(pkcs11.CKR_SESSION_CLOSED),
+		pkcs11.Error(pkcs11.CKR_DEVICE_REMOVED),
+		pkcs11.Error(pkcs11.CKR_TOKEN_NOT_PRESENT),
+		pkcs11.Error(pkcs11.CKR_USER_NOT_LOGGED_IN),
+		pkcs11.Error(pkcs11.CKR_DEVICE_ERROR):
+		return true
+	}
+	return false
+}
@@ -0,0 +1,27 @@
+//go:build !pkcs11
+// +build !pkcs11
+
+package hsm
+
+import (
+	"crypto"
+	"io"
+)
+
+type Signer struct{}
+
+func Open(uri *URI, pin string, pub crypto.PublicKey) (*Signer, error) {
+	return nil, ErrPKCS11NotAvail
+}
+
+func (s *Signer) Public() crypto.PublicKey {
+	return nil
+}
+
+func (s *Signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return nil, ErrPKCS11NotAvail
+}
+
+func (s *Signer) Close() error {
+	return nil
+}
@@ -0,0 +1,140 @@
+package hsm
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var ErrPKCS11NotAvail = errors.New("pkcs11 not available")
+
+// URI identifies a private key in a PKCS#11 token (RFC 7512)
+// e.g. pkcs11:token=letsdane;object=ca?module-path=/usr/lib/softhsm/libsofthsm2.so
+type URI struct {
+	Token  string
+	Serial string
+	Object string
+	ID     []byte
+	SlotID *uint
+
+	ModulePath string
+	PinValue   string
+	PinSource  string
+}
+
+// IsURI checks if s is a PKCS#11 URI
+func IsURI(s string) bool {
+	return strings.HasPrefix(s, "pkcs11:")
+}
+
+// ParseURI parses a PKCS#11 URI. Path attributes select the
+// token and key, query attributes specify the module and PIN.
+func ParseURI(s string) (*URI, error) {
+	if !IsURI(s) {
+		return nil, errors.New("pkcs11: uri must start with pkcs11:")
+	}
+
+	s = strings.TrimPrefix(s, "pkcs11:")
+	p, q := s, ""
+	if i := strings.IndexByte(s, '?'); i >= 0 {
+		p, q = s[:i], s[i+1:]
+	}
+
+	u := &URI{}
+	err := parseAttrs(p, ";", func(k, v string) error {
+		switch k {
+		case "token":
+			u.Token = v
+		case "serial":
+			u.Serial = v
+		case "object":
+			u.Object = v
+		case "id":
+			u.ID = []byte(v)
+		case "slot-id":
+			id, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return fmt.Errorf("bad slot-id: %v", err)
+			}
+			slot := uint(id)
+			u.SlotID = &slot
+		case "type":
+			if v != "private" {
+				return fmt.Errorf("unsupported object type %s", v)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = parseAttrs(q, "&", func(k, v string) error {
+		switch k {
+		case "module-path":
+			u.ModulePath = v
+		case "pin-value":
+			u.PinValue = v
+		case "pin-source":
+			u.PinSource = v
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if u.ModulePath == "" {
+		return nil, errors.New("pkcs11: module-path is required")
+	}
+	if u.Object == "" && u.ID == nil {
+		return nil, errors.New("pkcs11: object or id is required")
+	}
+
+	return u, nil
+}
+
+// PIN returns the PIN specified by pin-value or read
+// from the file in pin-source. It is empty if neither is set.
+func (u *URI) PIN() (string, error) {
+	if u.PinValue != "" {
+		return u.PinValue, nil
+	}
+	if u.PinSource == "" {
+		return "", nil
+	}
+
+	file := strings.TrimPrefix(u.PinSource, "file:")
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("pkcs11: read pin-source: %v", err)
+	}
+
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+func parseAttrs(s, sep string, fn func(k, v string) error) error {
+	if s == "" {
+		return nil
+	}
+
+	for _, attr := range strings.Split(s, sep) {
+		kv := strings.SplitN(attr, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("pkcs11: bad attribute %q", attr)
+		}
+
+		v, err := url.PathUnescape(kv[1])
+		if err != nil {
+			return fmt.Errorf("pkcs11: bad attribute %q: %v", attr, err)
+		}
+		if err := fn(kv[0], v); err != nil {
+			return fmt.Errorf("pkcs11: %v", err)
+		}
+	}
+
+	return nil
+}
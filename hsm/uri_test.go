@@ -0,0 +1,136 @@
+package hsm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseURI(t *testing.T) {
+	pinFile := filepath.Join(t.TempDir(), "pin")
+	if err := os.WriteFile(pinFile, []byte("4321\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	slot := uint(2)
+	tests := []struct {
+		uri  string
+		want *URI
+		pin  string
+		fail bool
+	}{
+		{
+			uri: "pkcs11:token=letsdane;object=ca?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-value=1234",
+			want: &URI{
+				Token:      "letsdane",
+				Object:     "ca",
+				ModulePath: "/usr/lib/softhsm/libsofthsm2.so",
+				PinValue:   "1234",
+			},
+			pin: "1234",
+		},
+		{
+			uri: "pkcs11:slot-id=2;id=%01%02;type=private?module-path=/lib/p11.so&pin-source=file:" + pinFile,
+			want: &URI{
+				ID:         []byte{1, 2},
+				SlotID:     &slot,
+				ModulePath: "/lib/p11.so",
+				PinSource:  "file:" + pinFile,
+			},
+			pin: "4321",
+		},
+		{
+			uri: "pkcs11:token=My%20Token;object=ca?module-path=/lib/p11.so",
+			want: &URI{
+				Token:      "My Token",
+				Object:     "ca",
+				ModulePath: "/lib/p11.so",
+			},
+		},
+		{uri: "/path/to/key.pem", fail: true},
+		{uri: "pkcs11:object=ca", fail: true},
+		{uri: "pkcs11:token=letsdane?module-path=/lib/p11.so", fail: true},
+		{uri: "pkcs11:object=ca;type=public?module-path=/lib/p11.so", fail: true},
+		{uri: "pkcs11:object?module-path=/lib/p11.so", fail: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.uri, func(t *testing.T) {
+			u, err := ParseURI(test.uri)
+			if test.fail {
+				if err == nil {
+					t.Fatal("got nil, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(u, test.want) {
+				t.Fatalf("got %+v, want %+v", u, test.want)
+			}
+
+			pin, err := u.PIN()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pin != test.pin {
+				t.Fatalf("pin = %q, want %q", pin, test.pin)
+			}
+		})
+	}
+}
+
+func TestEncode(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// public key attributes as stored in a token
+	params, _ := asn1.Marshal(oidNamedCurveP256)
+	point, _ := asn1.Marshal(elliptic.Marshal(elliptic.P256(), priv.X, priv.Y))
+	pub, err := ecPublicKey(params, point)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pub.Equal(priv.Public()) {
+		t.Fatal("ecPublicKey(): got different public key")
+	}
+
+	// raw r||s signature as returned by CKM_ECDSA
+	digest := sha256.Sum256([]byte("letsdane"))
+	r, s, err := ecdsa.Sign(rand.Reader, priv, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := make([]byte, 64)
+	r.FillBytes(raw[:32])
+	s.FillBytes(raw[32:])
+
+	sig, err := ecdsaSignature(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.VerifyASN1(pub, digest[:], sig) {
+		t.Fatal("ecdsaSignature(): signature does not verify")
+	}
+
+	info, err := digestInfo(crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info) != 19+32 {
+		t.Fatalf("len(digestInfo()) = %d, want %d", len(info), 19+32)
+	}
+	if _, err := digestInfo(crypto.SHA256, digest[:20]); err == nil {
+		t.Fatal("digestInfo(): got nil, want error for bad digest length")
+	}
+}
@@ -0,0 +1,182 @@
+package letsdane
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxOverride is the longest time a user can
+// proceed to a site failing validation
+const maxOverride = 24 * time.Hour
+
+// override is a user approved exception allowing connections
+// to a host presenting a certificate that failed validation
+type override struct {
+	Host       string    `json:"host"`
+	Port       string    `json:"port"`
+	CertSHA256 string    `json:"cert_sha256"`
+	Client     string    `json:"client"`
+	Created    time.Time `json:"created"`
+	Expires    time.Time `json:"expires"`
+}
+
+// overrideStore keeps track of user approved overrides. Overrides
+// are submitted from the error page using a token bound to the host
+// and certificate so that other sites can't create them.
+type overrideStore struct {
+	file   string
+	url    string
+	secret []byte
+
+	mu        sync.Mutex
+	overrides []*override
+}
+
+// loadOverrideStore creates an override store backed by file.
+// A missing file results in an empty store.
+func loadOverrideStore(file, url string) (*overrideStore, error) {
+	s := &overrideStore{
+		file:   file,
+		url:    url,
+		secret: make([]byte, 32),
+	}
+	if _, err := rand.Read(s.secret); err != nil {
+		return nil, err
+	}
+	if file == "" {
+		return s, nil
+	}
+
+	b, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.overrides); err != nil {
+		return nil, fmt.Errorf("overrides %s: %v", file, err)
+	}
+
+	return s, nil
+}
+
+// token returns the token authorizing an override for
+// the host, port and certificate fingerprint
+func (s *overrideStore) token(host, port, certSHA256 string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s", host, port, certSHA256)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// allowed returns the expiry of an override matching
+// the host, port and the exact certificate
+func (s *overrideStore) allowed(host, port string, cert *x509.Certificate) (time.Time, bool) {
+	if s == nil {
+		return time.Time{}, false
+	}
+
+	h := sha256.Sum256(cert.Raw)
+	fp := hex.EncodeToString(h[:])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, o := range s.overrides {
+		if o.Host == host && o.Port == port && o.CertSHA256 == fp && now.Before(o.Expires) {
+			return o.Expires, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// add records an override and persists the store
+func (s *overrideStore) add(o *override) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	overrides := []*override{o}
+	for _, old := range s.overrides {
+		if now.After(old.Expires) || (old.Host == o.Host && old.Port == o.Port && old.CertSHA256 == o.CertSHA256) {
+			continue
+		}
+		overrides = append(overrides, old)
+	}
+	s.overrides = overrides
+
+	if s.file == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(s.overrides)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.file+".tmp", b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(s.file+".tmp", s.file)
+}
+
+// ServeHTTP handles overrides submitted from the error page
+// and redirects the client back to the site.
+func (s *overrideStore) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	host, port, fp := req.PostFormValue("host"), req.PostFormValue("port"), req.PostFormValue("cert")
+	if !hmac.Equal([]byte(req.PostFormValue("token")), []byte(s.token(host, port, fp))) {
+		log.Printf("[AUDIT] override: rejected bad token from %s for %s", req.RemoteAddr, net.JoinHostPort(host, port))
+		httpError(w, "Invalid override token", http.StatusForbidden)
+		return
+	}
+
+	hours, err := strconv.Atoi(req.PostFormValue("hours"))
+	if err != nil || hours < 1 || time.Duration(hours)*time.Hour > maxOverride {
+		httpError(w, fmt.Sprintf("Hours must be between 1 and %d", int(maxOverride.Hours())), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	o := &override{
+		Host:       host,
+		Port:       port,
+		CertSHA256: fp,
+		Client:     req.RemoteAddr,
+		Created:    now,
+		Expires:    now.Add(time.Duration(hours) * time.Hour),
+	}
+	if err := s.add(o); err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[AUDIT] override: %s allowed %s with certificate sha256 %s until %s",
+		o.Client, net.JoinHostPort(host, port), fp, o.Expires.Format(time.RFC3339))
+
+	target := "https://" + host + "/"
+	if port != "443" {
+		target = "https://" + net.JoinHostPort(host, port) + "/"
+	}
+	http.Redirect(w, req, target, http.StatusSeeOther)
+}
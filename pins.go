@@ -0,0 +1,262 @@
+package letsdane
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pinSaveInterval limits how often refreshed pins are written to disk
+const pinSaveInterval = time.Hour
+
+// DANEPin records that a host previously presented valid
+// DANE authenticated TLS. Similar to HSTS, DANE remains
+// required for the host until the pin expires.
+type DANEPin struct {
+	Host      string    `json:"host"`
+	Port      string    `json:"port"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Expires   time.Time `json:"expires"`
+}
+
+// pinStore keeps track of learned DANE pins. If file is set
+// pins are persisted and reloaded when the file is changed
+// by another process (e.g. letsdane pins clear).
+type pinStore struct {
+	file   string
+	maxAge time.Duration
+
+	mu      sync.Mutex
+	pins    map[string]*DANEPin
+	modTime time.Time
+	saved   map[string]time.Time
+}
+
+// loadPinStore creates a pin store backed by file.
+// A missing file results in an empty store.
+func loadPinStore(file string, maxAge time.Duration) (*pinStore, error) {
+	s := &pinStore{
+		file:   file,
+		maxAge: maxAge,
+		pins:   make(map[string]*DANEPin),
+		saved:  make(map[string]time.Time),
+	}
+
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// pinned returns the expiry of an active pin for host and port
+func (s *pinStore) pinned(host, port string) (time.Time, bool) {
+	if s == nil {
+		return time.Time{}, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// errors are ignored to keep the last known pins
+	_ = s.reload()
+
+	p, ok := s.pins[net.JoinHostPort(pinHost(host), port)]
+	if !ok || time.Now().After(p.Expires) {
+		return time.Time{}, false
+	}
+
+	return p.Expires, true
+}
+
+// add pins host and port or extends an existing pin by maxAge
+func (s *pinStore) add(host, port string) error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_ = s.reload()
+
+	now := time.Now()
+	host = pinHost(host)
+	key := net.JoinHostPort(host, port)
+	p, ok := s.pins[key]
+	if !ok || now.After(p.Expires) {
+		p = &DANEPin{
+			Host:      host,
+			Port:      port,
+			FirstSeen: now,
+		}
+		s.pins[key] = p
+	}
+	p.LastSeen = now
+	p.Expires = now.Add(s.maxAge)
+
+	if ok && now.Sub(s.saved[key]) < pinSaveInterval {
+		return nil
+	}
+	s.saved[key] = now
+
+	return s.save()
+}
+
+// pinHost returns the form of host used as a pin key
+func pinHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// reload reads the pins from disk if the file has been
+// modified since it was last read. The caller must hold s.mu.
+func (s *pinStore) reload() error {
+	if s.file == "" {
+		return nil
+	}
+
+	fi, err := os.Stat(s.file)
+	if errors.Is(err, os.ErrNotExist) {
+		s.pins = make(map[string]*DANEPin)
+		s.modTime = time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	pins, err := readPins(s.file)
+	if err != nil {
+		return err
+	}
+
+	s.pins = make(map[string]*DANEPin, len(pins))
+	for _, p := range pins {
+		p.Host = pinHost(p.Host)
+		s.pins[net.JoinHostPort(p.Host, p.Port)] = p
+	}
+	s.modTime = fi.ModTime()
+
+	return nil
+}
+
+// save prunes expired pins and writes the store to disk.
+// The caller must hold s.mu.
+func (s *pinStore) save() error {
+	now := time.Now()
+	pins := make([]*DANEPin, 0, len(s.pins))
+	for key, p := range s.pins {
+		if now.After(p.Expires) {
+			delete(s.pins, key)
+			continue
+		}
+		pins = append(pins, p)
+	}
+
+	if s.file == "" {
+		return nil
+	}
+
+	if err := writePins(s.file, pins); err != nil {
+		return err
+	}
+
+	if fi, err := os.Stat(s.file); err == nil {
+		s.modTime = fi.ModTime()
+	}
+
+	return nil
+}
+
+func readPins(file string) ([]*DANEPin, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var pins []*DANEPin
+	if err := json.Unmarshal(b, &pins); err != nil {
+		return nil, fmt.Errorf("pins %s: %v", file, err)
+	}
+
+	return pins, nil
+}
+
+func writePins(file string, pins []*DANEPin) error {
+	b, err := json.Marshal(pins)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(file+".tmp", b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(file+".tmp", file)
+}
+
+// ReadPins returns the unexpired DANE pins stored in file
+// sorted by host and port.
+func ReadPins(file string) ([]*DANEPin, error) {
+	pins, err := readPins(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	active := pins[:0]
+	for _, p := range pins {
+		if now.Before(p.Expires) {
+			active = append(active, p)
+		}
+	}
+
+	sort.Slice(active, func(i, j int) bool {
+		if active[i].Host != active[j].Host {
+			return active[i].Host < active[j].Host
+		}
+		return active[i].Port < active[j].Port
+	})
+
+	return active, nil
+}
+
+// ClearPins removes the pins for the given hosts from file
+// or all pins if no hosts are given. It returns the number
+// of pins removed.
+func ClearPins(file string, hosts ...string) (int, error) {
+	pins, err := ReadPins(file)
+	if err != nil || len(pins) == 0 {
+		return 0, err
+	}
+
+	remove := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		remove[pinHost(host)] = true
+	}
+
+	var keep []*DANEPin
+	for _, p := range pins {
+		if len(hosts) > 0 && !remove[pinHost(p.Host)] {
+			keep = append(keep, p)
+		}
+	}
+	if keep == nil {
+		keep = []*DANEPin{}
+	}
+
+	return len(pins) - len(keep), writePins(file, keep)
+}
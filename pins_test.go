@@ -0,0 +1,88 @@
+package letsdane
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPinStore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "pins.json")
+	s, err := loadPinStore(file, time.Hour)
+	if err != nil {
+		t.Fatalf("loadPinStore(): got %v, want no error", err)
+	}
+
+	if _, ok := s.pinned("example.com", "443"); ok {
+		t.Fatal("pinned(): got true before add")
+	}
+	if err := s.add("example.com", "443"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.add("example.org", "443"); err != nil {
+		t.Fatal(err)
+	}
+
+	expires, ok := s.pinned("example.com", "443")
+	if !ok {
+		t.Fatal("pinned(): got false, want true")
+	}
+	if d := time.Until(expires); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("expires: got %v, want ~1h", d)
+	}
+	if _, ok := s.pinned("Example.COM.", "443"); !ok {
+		t.Error("pinned(): got false for case variant, want true")
+	}
+	if _, ok := s.pinned("example.com", "8443"); ok {
+		t.Error("pinned(): pin should be specific to the port")
+	}
+
+	// reload from disk
+	s, err = loadPinStore(file, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.pinned("example.com", "443"); !ok {
+		t.Fatal("pinned() after reload: got false, want true")
+	}
+
+	pins, err := ReadPins(file)
+	if err != nil || len(pins) != 2 || pins[0].Host != "example.com" {
+		t.Fatalf("ReadPins(): got %v, %v", pins, err)
+	}
+
+	// cleared by another process
+	time.Sleep(10 * time.Millisecond)
+	if n, err := ClearPins(file, "EXAMPLE.com."); err != nil || n != 1 {
+		t.Fatalf("ClearPins(): got %d, %v, want 1, no error", n, err)
+	}
+	if _, ok := s.pinned("example.com", "443"); ok {
+		t.Error("pinned() after clear: got true, want false")
+	}
+	if _, ok := s.pinned("example.org", "443"); !ok {
+		t.Error("pinned(): other pins should be kept")
+	}
+
+	if n, err := ClearPins(file); err != nil || n != 1 {
+		t.Fatalf("ClearPins(): got %d, %v, want 1, no error", n, err)
+	}
+	if pins, _ := ReadPins(file); len(pins) != 0 {
+		t.Errorf("ReadPins(): got %d pins, want 0", len(pins))
+	}
+
+	// expired pins
+	s.maxAge = -time.Second
+	if err := s.add("example.net", "443"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.pinned("example.net", "443"); ok {
+		t.Error("pinned(): got true for expired pin")
+	}
+
+	os.Remove(file)
+	var nilStore *pinStore
+	if _, ok := nilStore.pinned("example.com", "443"); ok {
+		t.Error("nil store: got pinned")
+	}
+}
@@ -0,0 +1,110 @@
+package letsdane
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// domainSet matches host names against a list of domains
+// and wildcard suffixes such as *.example.com
+type domainSet struct {
+	names    map[string]struct{}
+	suffixes map[string]struct{}
+}
+
+// newDomainSet creates a domain set from the given patterns.
+// A pattern is either a domain name matching itself only or
+// *.domain matching all names below domain.
+func newDomainSet(patterns []string) (*domainSet, error) {
+	s := &domainSet{
+		names:    make(map[string]struct{}),
+		suffixes: make(map[string]struct{}),
+	}
+
+	for _, p := range patterns {
+		p = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(p)), ".")
+		wildcard := strings.HasPrefix(p, "*.")
+		name := strings.TrimPrefix(p, "*.")
+		if name == "" || strings.ContainsAny(name, "* /:") || strings.Contains(name, "..") || name[0] == '.' {
+			return nil, fmt.Errorf("bad domain pattern %q", p)
+		}
+
+		if wildcard {
+			s.suffixes[name] = struct{}{}
+			continue
+		}
+		s.names[name] = struct{}{}
+	}
+
+	return s, nil
+}
+
+// match checks if host matches any of the patterns
+func (s *domainSet) match(host string) bool {
+	if s == nil {
+		return false
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if _, ok := s.names[host]; ok {
+		return true
+	}
+
+	for i := strings.IndexByte(host, '.'); i >= 0; i = strings.IndexByte(host, '.') {
+		host = host[i+1:]
+		if _, ok := s.suffixes[host]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hostPortSet matches destinations against domain patterns
+// optionally restricted to a port such as example.com:443
+type hostPortSet struct {
+	all   *domainSet
+	ports map[string]*domainSet
+}
+
+// newHostPortSet creates a host port set from the given patterns.
+// See newDomainSet for the domain pattern syntax.
+func newHostPortSet(patterns []string) (*hostPortSet, error) {
+	byPort := make(map[string][]string)
+	for _, p := range patterns {
+		p = strings.TrimSpace(p)
+		port := ""
+		if i := strings.LastIndexByte(p, ':'); i >= 0 {
+			p, port = p[:i], p[i+1:]
+			if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+				return nil, fmt.Errorf("bad port in pattern %q", p+":"+port)
+			}
+		}
+		byPort[port] = append(byPort[port], p)
+	}
+
+	s := &hostPortSet{ports: make(map[string]*domainSet)}
+	for port, patterns := range byPort {
+		set, err := newDomainSet(patterns)
+		if err != nil {
+			return nil, err
+		}
+		if port == "" {
+			s.all = set
+			continue
+		}
+		s.ports[port] = set
+	}
+
+	return s, nil
+}
+
+// match checks if host and port match any of the patterns
+func (s *hostPortSet) match(host, port string) bool {
+	if s == nil {
+		return false
+	}
+
+	return s.all.match(host) || s.ports[port].match(host)
+}
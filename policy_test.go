@@ -0,0 +1,75 @@
+package letsdane
+
+import "testing"
+
+func TestDomainSet(t *testing.T) {
+	s, err := newDomainSet([]string{"example.com", "*.Example.ORG.", "*.3b"})
+	if err != nil {
+		t.Fatalf("newDomainSet(): got %v, want no error", err)
+	}
+
+	var tests = []struct {
+		host  string
+		match bool
+	}{
+		{"example.com", true},
+		{"EXAMPLE.com.", true},
+		{"www.example.com", false},
+		{"example.org", false},
+		{"www.example.org", true},
+		{"a.b.example.org", true},
+		{"badexample.org", false},
+		{"foo.3b", true},
+		{"3b", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if got := s.match(test.host); got != test.match {
+			t.Errorf("match(%q): got %v, want %v", test.host, got, test.match)
+		}
+	}
+
+	var nilSet *domainSet
+	if nilSet.match("example.com") {
+		t.Error("nil set: got match")
+	}
+
+	for _, bad := range []string{"", "*.", "foo.*.com", "a..b", ".com", "example.com:443"} {
+		if _, err := newDomainSet([]string{bad}); err == nil {
+			t.Errorf("newDomainSet(%q): got no error", bad)
+		}
+	}
+}
+
+func TestHostPortSet(t *testing.T) {
+	s, err := newHostPortSet([]string{"example.com", "*.example.org:443", "bank.3b:8443"})
+	if err != nil {
+		t.Fatalf("newHostPortSet(): got %v, want no error", err)
+	}
+
+	var tests = []struct {
+		host, port string
+		match      bool
+	}{
+		{"example.com", "443", true},
+		{"example.com", "8443", true},
+		{"www.example.org", "443", true},
+		{"www.example.org", "8443", false},
+		{"bank.3b", "8443", true},
+		{"bank.3b", "443", false},
+		{"example.net", "443", false},
+	}
+
+	for _, test := range tests {
+		if got := s.match(test.host, test.port); got != test.match {
+			t.Errorf("match(%q, %q): got %v, want %v", test.host, test.port, got, test.match)
+		}
+	}
+
+	for _, bad := range []string{"example.com:", "example.com:0", "example.com:https", ":443"} {
+		if _, err := newHostPortSet([]string{bad}); err == nil {
+			t.Errorf("newHostPortSet(%q): got no error", bad)
+		}
+	}
+}
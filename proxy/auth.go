@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type identityKey struct{}
+
+// WithIdentity returns a copy of ctx carrying the
+// identity of the authenticated proxy client.
+func WithIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// IdentityFromContext returns the identity of the authenticated
+// proxy client if any. Tunnelers use it for logging and policy.
+func IdentityFromContext(ctx context.Context) (string, bool) {
+	identity, ok := ctx.Value(identityKey{}).(string)
+	return identity, ok
+}
+
+// allowedAddr checks if the client address addr
+// (host:port) is within one of the networks
+func allowedAddr(nets []*net.IPNet, addr string) bool {
+	if nets == nil {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// proxyAuth checks the Basic Proxy-Authorization credentials
+// of req returning the authenticated username
+func proxyAuth(req *http.Request, authenticate func(username, password string) bool) (string, bool) {
+	auth := req.Header.Get("Proxy-Authorization")
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", false
+	}
+
+	b, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", false
+	}
+	username, password, ok := strings.Cut(string(b), ":")
+	if !ok || !authenticate(username, password) {
+		return "", false
+	}
+
+	return username, true
+}
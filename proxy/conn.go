@@ -3,14 +3,17 @@ package proxy
 import (
 	"bytes"
 	"crypto/tls"
+	"errors"
 	"io"
 	"net"
+	"net/http"
 	"time"
 )
 
 // Conn represents a proxy connection
 type Conn struct {
-	wh func(int)
+	wh    func(int)
+	abort func()
 	net.Conn
 }
 
@@ -43,43 +46,77 @@ func (pc *Conn) Copy(dst net.Conn) {
 	defer pc.Close()
 	defer dst.Close()
 
-	done := make(chan struct{})
-	copyFunc := func(dst, src io.ReadWriteCloser) {
-		io.Copy(src, dst)
-		done <- struct{}{}
+	remoteDone := make(chan error, 1)
+	clientDone := make(chan error, 1)
+	copyFunc := func(dst, src io.ReadWriteCloser, done chan error) {
+		_, err := io.Copy(src, dst)
+		done <- err
 	}
 
-	go copyFunc(pc, dst)
-	go copyFunc(dst, pc)
+	go copyFunc(pc, dst, clientDone)
+	go copyFunc(dst, pc, remoteDone)
 
-	<-done
+	select {
+	case err := <-remoteDone:
+		// propagate remote failures e.g. connection resets
+		// as stream resets to HTTP/2 clients
+		if err != nil && pc.abort != nil {
+			pc.abort()
+		}
+	case <-clientDone:
+	}
 }
 
 // used if ResponseWriter doesn't implement http.Hijacker
+// e.g. for HTTP/2 streams
 type hijackConn struct {
 	io.Writer
 	io.ReadCloser
+	rc                    *http.ResponseController
 	localAddr, remoteAddr net.Addr
-	flush                 func()
+	aborted               bool
 }
 
 func (c *hijackConn) Write(b []byte) (n int, err error) {
 	n, err = c.Writer.Write(b)
-	if c.flush != nil {
-		c.flush()
+	if err == nil {
+		err = ignoreNotSupported(c.rc.Flush())
 	}
 	return
 }
 
+// abort marks the stream to be reset once the tunnel is closed
+func (c *hijackConn) abort() {
+	c.aborted = true
+}
+
 func (c *hijackConn) LocalAddr() net.Addr { return c.localAddr }
 
 func (c *hijackConn) RemoteAddr() net.Addr { return c.remoteAddr }
 
-func (c *hijackConn) SetDeadline(t time.Time) error { return nil }
+func (c *hijackConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
 
-func (c *hijackConn) SetReadDeadline(t time.Time) error { return nil }
+func (c *hijackConn) SetReadDeadline(t time.Time) error {
+	return ignoreNotSupported(c.rc.SetReadDeadline(t))
+}
+
+func (c *hijackConn) SetWriteDeadline(t time.Time) error {
+	return ignoreNotSupported(c.rc.SetWriteDeadline(t))
+}
 
-func (c *hijackConn) SetWriteDeadline(t time.Time) error { return nil }
+// ignoreNotSupported ignores errors from response writers
+// without flush or deadline support
+func ignoreNotSupported(err error) error {
+	if errors.Is(err, http.ErrNotSupported) {
+		return nil
+	}
+	return err
+}
 
 // reads client hello from the given connection without consuming the tls handshake
 // returns a newConn that must be used for future operations
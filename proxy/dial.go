@@ -0,0 +1,286 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// A Dialer connects to destinations through a parent proxy
+// using HTTP CONNECT (http and https URLs) or SOCKS5 (socks5 and
+// socks5h URLs). Destination names are resolved by the parent proxy
+// except for socks5 URLs, which send it the resolved address.
+// Credentials are taken from the URL's user info.
+type Dialer struct {
+	URL *url.URL
+
+	// Forward optionally dials the parent proxy
+	Forward func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Resolver resolves destination names for socks5 URLs.
+	// If nil, net.DefaultResolver is used.
+	Resolver *net.Resolver
+}
+
+// NewDialer creates a dialer for the parent proxy at u
+func NewDialer(u *url.URL) (*Dialer, error) {
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("proxy url %s has no host", u.Redacted())
+	}
+
+	return &Dialer{URL: u}, nil
+}
+
+// String returns the parent proxy url without the password
+func (d *Dialer) String() string {
+	return d.URL.Redacted()
+}
+
+// ResolvesNames reports whether destination names
+// are resolved by the parent proxy
+func (d *Dialer) ResolvesNames() bool {
+	return d.URL.Scheme != "socks5"
+}
+
+// DialContext connects to addr through the parent proxy
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if !d.ResolvesNames() {
+		var err error
+		if addr, err = d.resolve(ctx, network, addr); err != nil {
+			return nil, err
+		}
+	}
+
+	proxyAddr := d.URL.Host
+	if d.URL.Port() == "" {
+		proxyAddr = net.JoinHostPort(d.URL.Hostname(), defaultProxyPort(d.URL.Scheme))
+	}
+
+	forward := d.Forward
+	if forward == nil {
+		var nd net.Dialer
+		forward = nd.DialContext
+	}
+	c, err := forward(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	} else {
+		c.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	}
+
+	if d.URL.Scheme == "https" {
+		tc := tls.Client(c, &tls.Config{ServerName: d.URL.Hostname()})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			c.Close()
+			return nil, err
+		}
+		c = tc
+	}
+
+	conn := c
+	switch d.URL.Scheme {
+	case "http", "https":
+		conn, err = d.connect(c, addr)
+	default:
+		err = d.socksConnect(c, addr)
+	}
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("proxy %s: %v", d.URL.Host, err)
+	}
+
+	c.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// connect sends an HTTP CONNECT request for addr
+func (d *Dialer) connect(c net.Conn, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := d.URL.User; u != nil {
+		password, _ := u.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(c); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT %s: %s", addr, res.Status)
+	}
+
+	// the remote may speak first e.g. smtp
+	if br.Buffered() > 0 {
+		return &bufferedConn{r: br, Conn: c}, nil
+	}
+	return c, nil
+}
+
+// socksConnect performs a SOCKS5 handshake requesting addr
+func (d *Dialer) socksConnect(c net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("bad port %s", portStr)
+	}
+
+	method := byte(socksAuthNone)
+	if d.URL.User != nil {
+		method = socksAuthPassword
+	}
+	if _, err := c.Write([]byte{socksVersion, 1, method}); err != nil {
+		return err
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != socksVersion || buf[1] != method {
+		return errors.New("socks: no acceptable authentication method")
+	}
+
+	if method == socksAuthPassword {
+		username := d.URL.User.Username()
+		password, _ := d.URL.User.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("socks: credentials too long")
+		}
+		req := []byte{socksPasswordVersion, byte(len(username))}
+		req = append(req, username...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err := c.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c, buf[:2]); err != nil {
+			return err
+		}
+		if buf[1] != 0x00 {
+			return errors.New("socks: authentication failed")
+		}
+	}
+
+	req := []byte{socksVersion, socksCmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("socks: host name too long")
+		}
+		req = append(req, socksAddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socksAddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socksAddrIPv6)
+		req = append(req, ip...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+
+	// VER REP RSV ATYP
+	if _, err := io.ReadFull(c, buf); err != nil {
+		return err
+	}
+	if buf[1] != socksSucceeded {
+		return fmt.Errorf("socks: CONNECT %s: reply %d", addr, buf[1])
+	}
+
+	// skip the bound address
+	var skip int
+	switch buf[3] {
+	case socksAddrIPv4:
+		skip = net.IPv4len
+	case socksAddrIPv6:
+		skip = net.IPv6len
+	case socksAddrDomain:
+		if _, err := io.ReadFull(c, buf[:1]); err != nil {
+			return err
+		}
+		skip = int(buf[0])
+	default:
+		return fmt.Errorf("socks: unsupported address type %d", buf[3])
+	}
+	_, err = io.ReadFull(c, make([]byte, skip+2))
+	return err
+}
+
+// resolve replaces the host name in addr with its first address
+func (d *Dialer) resolve(ctx context.Context, network, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return addr, err
+	}
+
+	r := d.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	ipNetwork := "ip"
+	switch network {
+	case "tcp4":
+		ipNetwork = "ip4"
+	case "tcp6":
+		ipNetwork = "ip6"
+	}
+	ips, err := r.LookupIP(ctx, ipNetwork, host)
+	if err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
+
+func defaultProxyPort(scheme string) string {
+	switch scheme {
+	case "https":
+		return "443"
+	case "socks5", "socks5h":
+		return "1080"
+	}
+	return "80"
+}
+
+// bufferedConn reads data buffered while
+// reading the CONNECT response first
+type bufferedConn struct {
+	r *bufio.Reader
+	net.Conn
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
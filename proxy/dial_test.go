@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestDialer(t *testing.T) {
+	var gotAddr, gotIdentity string
+	echo := TunnelerFunc(func(ctx context.Context, clientConn *Conn, network, addr string) {
+		defer clientConn.Close()
+		gotAddr = addr
+		gotIdentity, _ = IdentityFromContext(ctx)
+		if addr == "unreachable.example:443" {
+			clientConn.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		clientConn.WriteHeader(http.StatusOK)
+		io.Copy(clientConn, clientConn)
+	})
+	authenticate := func(username, password string) bool {
+		return username == "user" && password == "secret"
+	}
+
+	httpProxy := httptest.NewServer(&Handler{Tunneler: echo, Authenticate: authenticate})
+	defer httpProxy.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go (&SOCKSServer{Tunneler: echo, Authenticate: authenticate}).Serve(l)
+
+	httpURL, _ := url.Parse(httpProxy.URL)
+	socksURL := &url.URL{Scheme: "socks5h", Host: l.Addr().String()}
+
+	for _, u := range []*url.URL{httpURL, socksURL} {
+		t.Run(u.Scheme, func(t *testing.T) {
+			u.User = url.UserPassword("user", "secret")
+			d, err := NewDialer(u)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c, err := d.DialContext(context.Background(), "tcp", "example.onion:443")
+			if err != nil {
+				t.Fatalf("DialContext(): got %v, want no error", err)
+			}
+			defer c.Close()
+			if gotAddr != "example.onion:443" || gotIdentity != "user" {
+				t.Fatalf("got addr %s identity %s, want example.onion:443 user", gotAddr, gotIdentity)
+			}
+
+			c.Write([]byte("ping"))
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+				t.Fatalf("got %q %v, want ping", buf, err)
+			}
+
+			if _, err := d.DialContext(context.Background(), "tcp", "unreachable.example:443"); err == nil {
+				t.Fatal("got no error for an unreachable destination")
+			}
+
+			u.User = url.UserPassword("user", "wrong")
+			if _, err := d.DialContext(context.Background(), "tcp", "example.onion:443"); err == nil {
+				t.Fatal("got no error for wrong credentials")
+			}
+		})
+	}
+
+	// socks5 sends the locally resolved address
+	d, err := NewDialer(&url.URL{Scheme: "socks5", Host: l.Addr().String(), User: url.UserPassword("user", "secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.DialContext(context.Background(), "tcp4", "localhost:443")
+	if err != nil {
+		t.Fatalf("DialContext(): got %v, want no error", err)
+	}
+	c.Close()
+	if gotAddr != "127.0.0.1:443" {
+		t.Fatalf("got addr %s, want 127.0.0.1:443", gotAddr)
+	}
+
+	if _, err := NewDialer(&url.URL{Scheme: "ftp", Host: "proxy:21"}); err == nil {
+		t.Fatal("NewDialer(): got no error for an unsupported scheme")
+	}
+}
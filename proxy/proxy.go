@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strings"
 )
 
 // Tunneler is an interface representing the ability to handle a
@@ -16,6 +17,10 @@ type Tunneler interface {
 }
 
 // A Handler implements http.Handler for running a proxy.
+//
+// Extended CONNECT requests for the connect-tcp protocol are
+// tunneled as well, but net/http only accepts them over HTTP/2
+// if the program runs with GODEBUG=http2xconnect=1.
 type Handler struct {
 	// Tunneler specifies the mechanism for handling HTTP CONNECT
 	// tunnels.
@@ -23,6 +28,18 @@ type Handler struct {
 
 	// NonConnect is used for all other HTTP requests where HTTP method != CONNECT
 	NonConnect http.Handler
+
+	// Authenticate if set is called with the Basic Proxy-Authorization
+	// credentials of proxy requests (CONNECT and absolute urls). Requests
+	// without valid credentials are answered with 407 Proxy Authentication
+	// Required. The username is passed in the context (see IdentityFromContext).
+	Authenticate func(username, password string) bool
+
+	// Realm is the realm of the Proxy-Authenticate challenge
+	Realm string
+
+	// AllowedNets if set restricts clients to these source networks
+	AllowedNets []*net.IPNet
 }
 
 type netAddr struct {
@@ -46,18 +63,61 @@ func (t TunnelerFunc) Tunnel(ctx context.Context, clientConn *Conn, network, add
 }
 
 func (p *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !allowedAddr(p.AllowedNets, req.RemoteAddr) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	ctx := context.Background()
+	if p.Authenticate != nil && (req.Method == http.MethodConnect || req.URL.IsAbs()) {
+		username, ok := proxyAuth(req, p.Authenticate)
+		if !ok {
+			realm := p.Realm
+			if realm == "" {
+				realm = "proxy"
+			}
+			w.Header().Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+			http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+
+		// credentials must not be forwarded
+		req.Header.Del("Proxy-Authorization")
+		ctx = WithIdentity(ctx, username)
+		req = req.WithContext(WithIdentity(req.Context(), username))
+	}
+
 	if req.Method != http.MethodConnect {
 		p.NonConnect.ServeHTTP(w, req)
 		return
 	}
 
+	// extended CONNECT (RFC 8441) streams carry the
+	// target in the path instead of the authority
+	addr := req.URL.Host
+	if protocol := req.Header.Get(":protocol"); protocol != "" {
+		var ok bool
+		if addr, ok = connectTCPTarget(protocol, req.URL.Path); !ok {
+			http.Error(w, "Unsupported protocol", http.StatusNotImplemented)
+			return
+		}
+	}
+
 	conn, writeHeader := hijacker(w, req)
 	pc := Conn{
 		wh:   writeHeader,
 		Conn: conn,
 	}
+	if sc, ok := conn.(*hijackConn); ok {
+		pc.abort = sc.abort
+		defer func() {
+			// resets the stream instead of closing it cleanly
+			if sc.aborted {
+				panic(http.ErrAbortHandler)
+			}
+		}()
+	}
 
-	addr := req.URL.Host
 	if addr == "" {
 		pc.WriteHeader(http.StatusBadRequest)
 		pc.Close()
@@ -75,7 +135,7 @@ func (p *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		network = pc.LocalAddr().Network()
 	}
 
-	p.Tunneler.Tunnel(context.Background(), &pc, network, addr)
+	p.Tunneler.Tunnel(ctx, &pc, network, addr)
 }
 
 // hijacker takes over the connection used by http.ResponseWriter
@@ -107,18 +167,14 @@ func hijacker(w http.ResponseWriter, req *http.Request) (c net.Conn, writeHeader
 		rwc := &hijackConn{
 			Writer:     w,
 			ReadCloser: req.Body,
+			rc:         http.NewResponseController(w),
 			localAddr:  localAddr,
 			remoteAddr: remoteAddr,
 		}
-		if f, ok := rwc.Writer.(http.Flusher); ok {
-			rwc.flush = func() {
-				f.Flush()
-			}
-		}
 
 		writeHeader = func(code int) {
 			w.WriteHeader(code)
-			rwc.flush()
+			rwc.rc.Flush()
 		}
 
 		c = rwc
@@ -126,3 +182,24 @@ func hijacker(w http.ResponseWriter, req *http.Request) (c net.Conn, writeHeader
 
 	return
 }
+
+// connectTCPTarget returns the target of an extended CONNECT
+// request for the connect-tcp protocol using the default
+// template /.well-known/masque/tcp/{target_host}/{tcp_port}/
+func connectTCPTarget(protocol, path string) (string, bool) {
+	if protocol != "connect-tcp" {
+		return "", false
+	}
+
+	const prefix = "/.well-known/masque/tcp/"
+	if !strings.HasPrefix(path, prefix) {
+		return "", false
+	}
+
+	parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(path, prefix), "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", false
+	}
+
+	return net.JoinHostPort(parts[0], parts[1]), true
+}
@@ -1,15 +1,24 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"os/exec"
+	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
 )
 
 func TestHijacker(t *testing.T) {
@@ -128,3 +137,295 @@ func TestHandler_ServeHTTPNonConnect(t *testing.T) {
 		t.Errorf("body = %s, wanted %s", string(b), "hello")
 	}
 }
+
+func TestHandler_HTTP2Connect(t *testing.T) {
+	// echoes until the client sends "reset" then resets the connection
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				b := make([]byte, 64)
+				for {
+					n, err := c.Read(b)
+					if err != nil {
+						c.Close()
+						return
+					}
+					if string(b[:n]) == "reset" {
+						c.(*net.TCPConn).SetLinger(0)
+						c.Close()
+						return
+					}
+					c.Write(b[:n])
+				}
+			}()
+		}
+	}()
+
+	dialer := &net.Dialer{}
+	proxySrv := httptest.NewUnstartedServer(&Handler{
+		Tunneler: TunnelerFunc(func(ctx context.Context, clientConn *Conn, network, addr string) {
+			defer clientConn.Close()
+			targetConn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				clientConn.WriteHeader(http.StatusBadGateway)
+				return
+			}
+
+			clientConn.WriteHeader(http.StatusOK)
+			clientConn.Copy(targetConn)
+		}),
+	})
+	proxySrv.Config.Protocols = &http.Protocols{}
+	proxySrv.Config.Protocols.SetHTTP1(true)
+	proxySrv.Config.Protocols.SetUnencryptedHTTP2(true)
+	proxySrv.Start()
+	defer proxySrv.Close()
+
+	tr := &http.Transport{Protocols: &http.Protocols{}}
+	tr.Protocols.SetUnencryptedHTTP2(true)
+	defer tr.CloseIdleConnections()
+
+	connect := func() (io.Writer, io.ReadCloser) {
+		pr, pw := io.Pipe()
+		req, _ := http.NewRequest(http.MethodConnect, proxySrv.URL, pr)
+		req.Host = target.Addr().String()
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK {
+			t.Fatalf("got %s %d, wanted HTTP/2.0 200", resp.Proto, resp.StatusCode)
+		}
+		return pw, resp.Body
+	}
+
+	// multiple tunnels multiplexed over one connection
+	w1, r1 := connect()
+	w2, r2 := connect()
+	for _, s := range []struct {
+		w io.Writer
+		r io.ReadCloser
+		m string
+	}{{w1, r1, "ping"}, {w2, r2, "pong"}} {
+		s.w.Write([]byte(s.m))
+		b := make([]byte, len(s.m))
+		if _, err := io.ReadFull(s.r, b); err != nil || string(b) != s.m {
+			t.Fatalf("got %q, %v, wanted %q", b, err, s.m)
+		}
+	}
+
+	// a reset remote resets the stream
+	w1.Write([]byte("reset"))
+	if _, err := io.ReadAll(r1); err == nil {
+		t.Fatal("got nil, wanted stream reset error")
+	}
+
+	w2.Write([]byte("still open"))
+	b := make([]byte, 10)
+	if _, err := io.ReadFull(r2, b); err != nil || string(b) != "still open" {
+		t.Fatalf("got %q, %v, wanted 'still open'", b, err)
+	}
+	r2.Close()
+}
+
+func TestHandler_ServeHTTPExtendedConnect(t *testing.T) {
+	// net/http reads http2xconnect from the environment
+	// on startup so the test runs in a child process
+	godebug := os.Getenv("GODEBUG")
+	if !strings.Contains(godebug, "http2xconnect=1") {
+		if godebug != "" {
+			godebug += ","
+		}
+		cmd := exec.Command(os.Args[0], "-test.run=^TestHandler_ServeHTTPExtendedConnect$", "-test.count=1")
+		cmd.Env = append(os.Environ(), "GODEBUG="+godebug+"http2xconnect=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%v\n%s", err, out)
+		}
+		return
+	}
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		c, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	var got string
+	dialer := &net.Dialer{}
+	proxy := &Handler{Tunneler: TunnelerFunc(func(ctx context.Context, clientConn *Conn, network, addr string) {
+		defer clientConn.Close()
+		got = addr
+		targetConn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			clientConn.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		clientConn.WriteHeader(http.StatusOK)
+		clientConn.Copy(targetConn)
+	})}
+	proxySrv := httptest.NewUnstartedServer(proxy)
+	proxySrv.Config.Protocols = &http.Protocols{}
+	proxySrv.Config.Protocols.SetUnencryptedHTTP2(true)
+	proxySrv.Start()
+	defer proxySrv.Close()
+
+	// http.Transport refuses to send :protocol so the
+	// h2c connection is driven frame by frame
+	conn, err := net.Dial("tcp", proxySrv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	io.WriteString(conn, http2.ClientPreface)
+	fr := http2.NewFramer(conn, conn)
+	fr.WriteSettings()
+
+	f, err := fr.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf, ok := f.(*http2.SettingsFrame)
+	if !ok {
+		t.Fatalf("got %T, wanted settings frame", f)
+	}
+	const settingEnableConnectProtocol = http2.SettingID(0x8)
+	if v, ok := sf.Value(settingEnableConnectProtocol); !ok || v != 1 {
+		t.Fatal("server does not allow extended CONNECT")
+	}
+	fr.WriteSettingsAck()
+
+	host, port, _ := net.SplitHostPort(target.Addr().String())
+	var hbuf bytes.Buffer
+	enc := hpack.NewEncoder(&hbuf)
+	for _, hf := range []hpack.HeaderField{
+		{Name: ":method", Value: http.MethodConnect},
+		{Name: ":protocol", Value: "connect-tcp"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":authority", Value: proxySrv.Listener.Addr().String()},
+		{Name: ":path", Value: "/.well-known/masque/tcp/" + host + "/" + port + "/"},
+	} {
+		enc.WriteField(hf)
+	}
+	fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: hbuf.Bytes(), EndHeaders: true})
+	fr.WriteData(1, false, []byte("ping"))
+
+	var status string
+	var data []byte
+	dec := hpack.NewDecoder(4096, nil)
+	for len(data) < 4 {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch f := f.(type) {
+		case *http2.HeadersFrame:
+			fields, err := dec.DecodeFull(f.HeaderBlockFragment())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, hf := range fields {
+				if hf.Name == ":status" {
+					status = hf.Value
+				}
+			}
+		case *http2.DataFrame:
+			data = append(data, f.Data()...)
+		case *http2.RSTStreamFrame:
+			t.Fatalf("got stream reset %v, wanted tunnel", f.ErrCode)
+		}
+	}
+	if status != "200" || got != target.Addr().String() {
+		t.Fatalf("got %s %s, wanted 200 %s", status, got, target.Addr())
+	}
+	if string(data) != "ping" {
+		t.Fatalf("got %q, wanted ping", data)
+	}
+
+	for _, bad := range []struct{ protocol, path string }{
+		{"websocket", "/chat"},
+		{"connect-tcp", "/.well-known/masque/tcp/example.com/"},
+		{"connect-tcp", "/other/example.com/443/"},
+	} {
+		req := httptest.NewRequest(http.MethodConnect, bad.path, nil)
+		req.Header.Set(":protocol", bad.protocol)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		if w.Code != http.StatusNotImplemented {
+			t.Errorf("%s %s: status = %d, wanted %d", bad.protocol, bad.path, w.Code, http.StatusNotImplemented)
+		}
+	}
+}
+
+func TestHandler_ServeHTTPAuth(t *testing.T) {
+	var identity string
+	_, allowed, _ := net.ParseCIDR("192.0.2.0/24")
+	h := &Handler{
+		Tunneler: TunnelerFunc(func(ctx context.Context, clientConn *Conn, network, addr string) {
+			identity, _ = IdentityFromContext(ctx)
+			clientConn.WriteHeader(http.StatusOK)
+		}),
+		NonConnect: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			identity, _ = IdentityFromContext(req.Context())
+			if req.Header.Get("Proxy-Authorization") != "" {
+				t.Error("Proxy-Authorization forwarded")
+			}
+		}),
+		Authenticate: func(username, password string) bool {
+			return username == "alice" && password == "secret"
+		},
+		Realm:       "letsdane",
+		AllowedNets: []*net.IPNet{allowed},
+	}
+
+	for _, test := range []struct {
+		method, target, auth, remote string
+		wantCode                     int
+		wantIdentity                 string
+	}{
+		{http.MethodConnect, "example.com:443", "", "192.0.2.1:1234", http.StatusProxyAuthRequired, ""},
+		{http.MethodGet, "http://example.com/", "", "192.0.2.1:1234", http.StatusProxyAuthRequired, ""},
+		{http.MethodConnect, "example.com:443", "alice:wrong", "192.0.2.1:1234", http.StatusProxyAuthRequired, ""},
+		{http.MethodConnect, "example.com:443", "alice:secret", "192.0.2.1:1234", http.StatusOK, "alice"},
+		{http.MethodGet, "http://example.com/", "alice:secret", "192.0.2.1:1234", http.StatusOK, "alice"},
+		{http.MethodConnect, "example.com:443", "alice:secret", "198.51.100.1:1234", http.StatusForbidden, ""},
+		// relative urls are not proxy requests
+		{http.MethodGet, "/crl", "", "192.0.2.1:1234", http.StatusOK, ""},
+	} {
+		identity = ""
+		req := httptest.NewRequest(test.method, test.target, nil)
+		req.RemoteAddr = test.remote
+		if test.auth != "" {
+			req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(test.auth)))
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != test.wantCode || identity != test.wantIdentity {
+			t.Errorf("%s %s (%s from %s): got %d %q, wanted %d %q", test.method, test.target, test.auth, test.remote,
+				w.Code, identity, test.wantCode, test.wantIdentity)
+		}
+		if w.Code == http.StatusProxyAuthRequired && w.Header().Get("Proxy-Authenticate") != `Basic realm="letsdane"` {
+			t.Errorf("Proxy-Authenticate = %q", w.Header().Get("Proxy-Authenticate"))
+		}
+	}
+}
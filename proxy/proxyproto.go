@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyProtoTimeout limits the time trusted
+// senders take to send the PROXY header
+const proxyProtoTimeout = 10 * time.Second
+
+var (
+	proxyProtoV1Prefix = []byte("PROXY ")
+	proxyProtoV2Sig    = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// A ProxyProtoListener accepts connections from load balancers
+// sending a PROXY protocol (v1 or v2) header. The client address
+// in the header is reported as the connection's RemoteAddr.
+type ProxyProtoListener struct {
+	net.Listener
+
+	// Trusted lists the networks of senders that must send a
+	// header. Connections from others are served as is so their
+	// address can't be spoofed.
+	Trusted []*net.IPNet
+}
+
+// Accept waits for the next connection. The header
+// is read on the first Read or RemoteAddr call.
+func (l *ProxyProtoListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if l.Trusted == nil || !allowedAddr(l.Trusted, c.RemoteAddr().String()) {
+		return c, nil
+	}
+
+	return &proxyProtoConn{Conn: c}, nil
+}
+
+// proxyProtoConn is a connection from a trusted sender
+type proxyProtoConn struct {
+	net.Conn
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyProtoConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyProtoTimeout))
+		c.remote, c.err = readProxyHeader(c.Conn)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.remote == nil {
+			c.remote = c.Conn.RemoteAddr()
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+// readProxyHeader reads a PROXY protocol header from r returning
+// the client address or nil if the header carries none (LOCAL
+// or UNKNOWN). It doesn't read past the header.
+func readProxyHeader(r io.Reader) (net.Addr, error) {
+	buf := make([]byte, 16)
+	if _, err := io.ReadFull(r, buf[:len(proxyProtoV1Prefix)]); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(buf[:len(proxyProtoV1Prefix)], proxyProtoV1Prefix) {
+		return readProxyHeaderV1(r)
+	}
+
+	// fail early on clients not sending a header at all
+	if !bytes.HasPrefix(proxyProtoV2Sig, buf[:len(proxyProtoV1Prefix)]) {
+		return nil, errors.New("proxy protocol: missing header")
+	}
+	if _, err := io.ReadFull(r, buf[len(proxyProtoV1Prefix):]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(buf[:len(proxyProtoV2Sig)], proxyProtoV2Sig) {
+		return nil, errors.New("proxy protocol: missing header")
+	}
+
+	return readProxyHeaderV2(r, buf[12:])
+}
+
+// readProxyHeaderV1 parses the rest of a text header
+// e.g. TCP4 192.0.2.1 192.0.2.2 56324 443\r\n
+func readProxyHeaderV1(r io.Reader) (net.Addr, error) {
+	// the whole line is at most 107 bytes
+	line := make([]byte, 0, 107-len(proxyProtoV1Prefix))
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == cap(line) {
+			return nil, errors.New("proxy protocol: v1 header too long")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) > 0 && fields[0] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return nil, fmt.Errorf("proxy protocol: bad v1 header %q", strings.TrimSpace(string(line)))
+	}
+
+	ip := net.ParseIP(fields[1])
+	port, err := strconv.ParseUint(fields[3], 10, 16)
+	if ip == nil || err != nil || (fields[0] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("proxy protocol: bad v1 source address %s %s", fields[1], fields[3])
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 parses a binary header given the
+// version/command, family and length bytes
+func readProxyHeaderV2(r io.Reader, hdr []byte) (net.Addr, error) {
+	verCmd, family := hdr[0], hdr[1]
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("proxy protocol: unsupported version %d", verCmd>>4)
+	}
+
+	// addresses followed by optional TLVs
+	data := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	switch verCmd & 0xf {
+	case 0x0:
+		// LOCAL e.g. health checks from the sender itself
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, fmt.Errorf("proxy protocol: unsupported command %d", verCmd&0xf)
+	}
+
+	var ipLen int
+	switch family {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		// unspecified, udp and unix sockets
+		return nil, nil
+	}
+	if len(data) < 2*ipLen+4 {
+		return nil, errors.New("proxy protocol: v2 address block too short")
+	}
+
+	return &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), data[:ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(data[2*ipLen:])),
+	}, nil
+}
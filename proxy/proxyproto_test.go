@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(cmd, family byte, addrs ...byte) []byte {
+		b := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x20|cmd, family, 0, byte(len(addrs)))
+		return append(b, addrs...)
+	}
+
+	var tests = []struct {
+		name     string
+		header   []byte
+		wantAddr string
+		wantErr  bool
+	}{
+		{
+			name:     "v1_tcp4",
+			header:   []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"),
+			wantAddr: "192.0.2.1:56324",
+		},
+		{
+			name:     "v1_tcp6",
+			header:   []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"),
+			wantAddr: "[2001:db8::1]:56324",
+		},
+		{
+			name:   "v1_unknown",
+			header: []byte("PROXY UNKNOWN\r\n"),
+		},
+		{
+			name:    "v1_family_mismatch",
+			header:  []byte("PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n"),
+			wantErr: true,
+		},
+		{
+			name:    "v1_too_long",
+			header:  append([]byte("PROXY TCP4 "), bytes.Repeat([]byte("1"), 120)...),
+			wantErr: true,
+		},
+		{
+			name:     "v2_tcp4",
+			header:   v2(1, 0x11, 192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0x01, 0xbb),
+			wantAddr: "192.0.2.1:56324",
+		},
+		{
+			name: "v2_tcp6_tlv",
+			header: v2(1, 0x21, append(append(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")...),
+				0xdc, 0x04, 0x01, 0xbb, 0x04, 0x00, 0x01, 0x00)...),
+			wantAddr: "[2001:db8::1]:56324",
+		},
+		{
+			name:   "v2_local",
+			header: v2(0, 0x00),
+		},
+		{
+			name:    "v2_short",
+			header:  v2(1, 0x11, 192, 0, 2, 1),
+			wantErr: true,
+		},
+		{
+			name:    "missing",
+			header:  []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := bytes.NewReader(append(test.header, "data"...))
+			addr, err := readProxyHeader(r)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("got addr %v, want error", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got %v, want no error", err)
+			}
+
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != test.wantAddr {
+				t.Fatalf("got addr %q, want %q", got, test.wantAddr)
+			}
+
+			// the header is consumed exactly
+			if rest, _ := io.ReadAll(r); string(rest) != "data" {
+				t.Fatalf("got %q after the header, want data", rest)
+			}
+		})
+	}
+}
+
+func TestProxyProtoListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, other, _ := net.ParseCIDR("192.0.2.0/24")
+	l := &ProxyProtoListener{Listener: ln, Trusted: []*net.IPNet{loopback}}
+
+	accept := func(t *testing.T, header string) net.Conn {
+		t.Helper()
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		c.Write([]byte(header + "ping"))
+
+		sc, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { sc.Close() })
+		return sc
+	}
+
+	t.Run("trusted", func(t *testing.T) {
+		c := accept(t, "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n")
+		if got := c.RemoteAddr().String(); got != "192.0.2.1:56324" {
+			t.Fatalf("got remote addr %s, want 192.0.2.1:56324", got)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("got %q %v, want ping", buf, err)
+		}
+	})
+
+	t.Run("trusted_missing_header", func(t *testing.T) {
+		c := accept(t, "GET / HTTP/1.1\r\n")
+		if _, err := c.Read(make([]byte, 4)); err == nil {
+			t.Fatal("got no error, want missing header error")
+		}
+	})
+
+	t.Run("untrusted", func(t *testing.T) {
+		l.Trusted = []*net.IPNet{other}
+		defer func() { l.Trusted = []*net.IPNet{loopback} }()
+
+		// the header isn't parsed so it can't spoof the address
+		header := "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"
+		c := accept(t, header)
+		if got := c.RemoteAddr().(*net.TCPAddr).IP.String(); got != "127.0.0.1" {
+			t.Fatalf("got remote addr %s, want 127.0.0.1", got)
+		}
+		buf := make([]byte, len(header))
+		if _, err := io.ReadFull(c, buf); err != nil || string(buf) != header {
+			t.Fatalf("got %q %v, want the header unparsed", buf, err)
+		}
+	})
+}
@@ -0,0 +1,233 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	socksVersion = 5
+
+	socksAuthNone        = 0x00
+	socksAuthPassword    = 0x02
+	socksNoAcceptable    = 0xff
+	socksPasswordVersion = 0x01
+
+	socksCmdConnect = 0x01
+
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+
+	socksSucceeded        = 0x00
+	socksGeneralFailure   = 0x01
+	socksNotAllowed       = 0x02
+	socksHostUnreachable  = 0x04
+	socksCmdNotSupported  = 0x07
+	socksAddrNotSupported = 0x08
+)
+
+// socksHandshakeTimeout limits the time clients
+// take to authenticate and send their request
+const socksHandshakeTimeout = 30 * time.Second
+
+// A SOCKSServer serves SOCKS5 (RFC 1928) clients and hands CONNECT
+// requests to a Tunneler. Domain names are passed to the tunneler
+// unresolved (SOCKS5h) so they are resolved by the proxy.
+type SOCKSServer struct {
+	// Tunneler specifies the mechanism for handling
+	// CONNECT requests.
+	Tunneler Tunneler
+
+	// Authenticate if set requires clients to use
+	// username/password authentication (RFC 1929).
+	// The username is passed in the context
+	// (see IdentityFromContext).
+	Authenticate func(username, password string) bool
+
+	// AllowedNets if set restricts clients to these source networks
+	AllowedNets []*net.IPNet
+}
+
+// Serve accepts connections on l and serves each in a new goroutine
+func (s *SOCKSServer) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.ServeConn(c)
+	}
+}
+
+// ServeConn serves a single SOCKS client connection
+func (s *SOCKSServer) ServeConn(c net.Conn) {
+	if !allowedAddr(s.AllowedNets, c.RemoteAddr().String()) {
+		c.Close()
+		return
+	}
+
+	c.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	addr, username, err := s.handshake(c)
+	if err != nil {
+		c.Close()
+		return
+	}
+	c.SetDeadline(time.Time{})
+
+	ctx := context.Background()
+	if s.Authenticate != nil {
+		ctx = WithIdentity(ctx, username)
+	}
+
+	pc := Conn{
+		wh: func(code int) {
+			writeSOCKSReply(c, socksReply(code))
+		},
+		Conn: c,
+	}
+
+	s.Tunneler.Tunnel(ctx, &pc, "tcp", addr)
+}
+
+// handshake negotiates the authentication method and reads
+// the request returning the target address and username
+func (s *SOCKSServer) handshake(c net.Conn) (addr, username string, err error) {
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return "", "", err
+	}
+	if buf[0] != socksVersion {
+		return "", "", fmt.Errorf("socks: unsupported version %d", buf[0])
+	}
+
+	methods := make([]byte, buf[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return "", "", err
+	}
+
+	method := byte(socksAuthNone)
+	if s.Authenticate != nil {
+		method = socksAuthPassword
+	}
+	if bytes.IndexByte(methods, method) < 0 {
+		c.Write([]byte{socksVersion, socksNoAcceptable})
+		return "", "", errors.New("socks: no acceptable authentication method")
+	}
+	if _, err := c.Write([]byte{socksVersion, method}); err != nil {
+		return "", "", err
+	}
+
+	if method == socksAuthPassword {
+		if username, err = s.authenticate(c); err != nil {
+			return "", "", err
+		}
+	}
+
+	// VER CMD RSV ATYP
+	if _, err := io.ReadFull(c, buf[:4]); err != nil {
+		return "", "", err
+	}
+	if buf[0] != socksVersion {
+		return "", "", fmt.Errorf("socks: unsupported version %d", buf[0])
+	}
+	cmd, atyp := buf[1], buf[3]
+
+	var host string
+	switch atyp {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp == socksAddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(c, ip); err != nil {
+			return "", "", err
+		}
+		host = ip.String()
+	case socksAddrDomain:
+		if _, err := io.ReadFull(c, buf[:1]); err != nil {
+			return "", "", err
+		}
+		name := make([]byte, buf[0])
+		if _, err := io.ReadFull(c, name); err != nil {
+			return "", "", err
+		}
+		host = string(name)
+	default:
+		writeSOCKSReply(c, socksAddrNotSupported)
+		return "", "", fmt.Errorf("socks: unsupported address type %d", atyp)
+	}
+
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return "", "", err
+	}
+	port := int(buf[0])<<8 | int(buf[1])
+
+	if cmd != socksCmdConnect {
+		writeSOCKSReply(c, socksCmdNotSupported)
+		return "", "", fmt.Errorf("socks: unsupported command %d", cmd)
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(port)), username, nil
+}
+
+// authenticate performs username/password authentication (RFC 1929)
+func (s *SOCKSServer) authenticate(c net.Conn) (string, error) {
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		return "", err
+	}
+	if buf[0] != socksPasswordVersion {
+		return "", fmt.Errorf("socks: unsupported auth version %d", buf[0])
+	}
+
+	username := make([]byte, buf[1])
+	if _, err := io.ReadFull(c, username); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(c, buf[:1]); err != nil {
+		return "", err
+	}
+	password := make([]byte, buf[0])
+	if _, err := io.ReadFull(c, password); err != nil {
+		return "", err
+	}
+
+	if !s.Authenticate(string(username), string(password)) {
+		c.Write([]byte{socksPasswordVersion, 0x01})
+		return "", errors.New("socks: authentication failed")
+	}
+
+	_, err := c.Write([]byte{socksPasswordVersion, 0x00})
+	return string(username), err
+}
+
+// socksReply maps the HTTP status written by a tunneler to a SOCKS reply
+func socksReply(code int) byte {
+	switch code {
+	case http.StatusOK:
+		return socksSucceeded
+	case http.StatusForbidden:
+		return socksNotAllowed
+	case http.StatusBadGateway:
+		return socksHostUnreachable
+	case http.StatusBadRequest:
+		return socksAddrNotSupported
+	}
+
+	return socksGeneralFailure
+}
+
+func writeSOCKSReply(c net.Conn, rep byte) {
+	// the bound address is not known since
+	// tunnelers dial the remote themselves
+	c.Write([]byte{socksVersion, rep, 0x00, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestSOCKSServer(t *testing.T) {
+	var gotAddr, gotIdentity string
+	s := &SOCKSServer{
+		Tunneler: TunnelerFunc(func(ctx context.Context, clientConn *Conn, network, addr string) {
+			defer clientConn.Close()
+			gotAddr = addr
+			gotIdentity, _ = IdentityFromContext(ctx)
+			if addr == "unreachable.example:443" {
+				clientConn.WriteHeader(http.StatusBadGateway)
+				return
+			}
+
+			clientConn.WriteHeader(http.StatusOK)
+			io.Copy(clientConn, clientConn)
+		}),
+	}
+
+	// exchange writes req and reads a reply of len(want) bytes
+	exchange := func(t *testing.T, c net.Conn, req, want []byte) {
+		t.Helper()
+		if _, err := c.Write(req); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(c, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+	serve := func() net.Conn {
+		client, server := net.Pipe()
+		go s.ServeConn(server)
+		return client
+	}
+
+	domainReq := func(name string, port int) []byte {
+		req := []byte{5, 1, 0, 3, byte(len(name))}
+		req = append(req, name...)
+		return append(req, byte(port>>8), byte(port))
+	}
+	succeeded := []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+
+	t.Run("domain", func(t *testing.T) {
+		c := serve()
+		defer c.Close()
+		exchange(t, c, []byte{5, 1, 0}, []byte{5, 0})
+		exchange(t, c, domainReq("example.com", 443), succeeded)
+		if gotAddr != "example.com:443" {
+			t.Fatalf("addr = %s, wanted example.com:443", gotAddr)
+		}
+		exchange(t, c, []byte("ping"), []byte("ping"))
+	})
+
+	t.Run("ipv6", func(t *testing.T) {
+		c := serve()
+		defer c.Close()
+		exchange(t, c, []byte{5, 1, 0}, []byte{5, 0})
+		req := append([]byte{5, 1, 0, 4}, net.ParseIP("2001:db8::1")...)
+		exchange(t, c, append(req, 0, 80), succeeded)
+		if gotAddr != "[2001:db8::1]:80" {
+			t.Fatalf("addr = %s, wanted [2001:db8::1]:80", gotAddr)
+		}
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		c := serve()
+		defer c.Close()
+		exchange(t, c, []byte{5, 1, 0}, []byte{5, 0})
+		exchange(t, c, domainReq("unreachable.example", 443), []byte{5, 4, 0, 1, 0, 0, 0, 0, 0, 0})
+	})
+
+	t.Run("unsupported_command", func(t *testing.T) {
+		c := serve()
+		defer c.Close()
+		exchange(t, c, []byte{5, 1, 0}, []byte{5, 0})
+		req := domainReq("example.com", 443)
+		req[1] = 2 // BIND
+		exchange(t, c, req, []byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0})
+	})
+
+	s.Authenticate = func(username, password string) bool {
+		return username == "user" && password == "secret"
+	}
+
+	t.Run("auth_required", func(t *testing.T) {
+		c := serve()
+		defer c.Close()
+		exchange(t, c, []byte{5, 1, 0}, []byte{5, 0xff})
+	})
+
+	t.Run("auth", func(t *testing.T) {
+		c := serve()
+		defer c.Close()
+		exchange(t, c, []byte{5, 2, 0, 2}, []byte{5, 2})
+		exchange(t, c, []byte("\x01\x04user\x06secret"), []byte{1, 0})
+		exchange(t, c, domainReq("example.com", 443), succeeded)
+		if gotIdentity != "user" {
+			t.Fatalf("identity = %q, wanted user", gotIdentity)
+		}
+	})
+
+	t.Run("not_allowed", func(t *testing.T) {
+		_, n, _ := net.ParseCIDR("192.0.2.0/24")
+		s.AllowedNets = []*net.IPNet{n}
+		defer func() { s.AllowedNets = nil }()
+
+		// pipe addresses aren't ip addresses
+		c := serve()
+		defer c.Close()
+		c.Write([]byte{5, 1, 0})
+		if _, err := c.Read(make([]byte, 1)); err == nil {
+			t.Fatal("got nil, want closed connection")
+		}
+	})
+
+	t.Run("auth_failed", func(t *testing.T) {
+		c := serve()
+		defer c.Close()
+		exchange(t, c, []byte{5, 1, 2}, []byte{5, 2})
+		exchange(t, c, []byte("\x01\x04user\x05wrong"), []byte{1, 1})
+		if _, err := c.Read(make([]byte, 1)); err == nil {
+			t.Fatal("got nil, want closed connection")
+		}
+	})
+}
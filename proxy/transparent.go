@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+)
+
+// A TransparentServer serves connections redirected to it by the
+// firewall (e.g. iptables REDIRECT or TPROXY on Linux) and hands them
+// to a Tunneler without a CONNECT request. The destination is the SNI
+// of the TLS ClientHello and the original destination address for
+// clients without SNI or TLS.
+type TransparentServer struct {
+	// Tunneler specifies the mechanism for handling
+	// redirected connections.
+	Tunneler Tunneler
+
+	// TPROXY if set indicates connections are redirected with
+	// TPROXY and keep their original destination as the local
+	// address. Otherwise it is recovered with SO_ORIGINAL_DST.
+	TPROXY bool
+
+	// AllowedNets if set restricts clients to these source networks
+	AllowedNets []*net.IPNet
+
+	// ListenAddrs are the addresses the proxy listens on. Connections
+	// whose original destination is one of them are refused since
+	// tunneling them would make the proxy connect to itself. Without
+	// TPROXY, so are connections to the local address of the connection.
+	ListenAddrs []net.Addr
+
+	// originalDst recovers the destination without TPROXY,
+	// replaced in tests
+	originalDst func(net.Conn) (*net.TCPAddr, error)
+}
+
+// Serve accepts connections on l and serves each in a new goroutine.
+// For TPROXY the listener must be created with ListenTransparent.
+func (s *TransparentServer) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.ServeConn(c)
+	}
+}
+
+// ServeConn serves a single redirected connection
+func (s *TransparentServer) ServeConn(c net.Conn) {
+	if !allowedAddr(s.AllowedNets, c.RemoteAddr().String()) {
+		c.Close()
+		return
+	}
+
+	dst, err := s.destination(c)
+	if err != nil || s.isSelf(c, dst) {
+		c.Close()
+		return
+	}
+
+	// there's no CONNECT handshake so the
+	// status is only known to the tunneler
+	pc := Conn{
+		wh:   func(int) {},
+		Conn: c,
+	}
+
+	host := dst.IP.String()
+	if hello, err := pc.PeekClientHello(); err == nil && hello.ServerName != "" {
+		host = hello.ServerName
+	}
+
+	s.Tunneler.Tunnel(context.Background(), &pc, "tcp", net.JoinHostPort(host, strconv.Itoa(dst.Port)))
+}
+
+// destination returns the original destination of c
+func (s *TransparentServer) destination(c net.Conn) (*net.TCPAddr, error) {
+	if !s.TPROXY {
+		if s.originalDst != nil {
+			return s.originalDst(c)
+		}
+		return originalDst(c)
+	}
+	if dst, ok := c.LocalAddr().(*net.TCPAddr); ok {
+		return dst, nil
+	}
+
+	return nil, errors.New("original destination: not a tcp connection")
+}
+
+// isSelf reports whether dst is one of the listen addresses or,
+// without TPROXY, the local address of c. Under TPROXY the local
+// address is the destination itself. Listen addresses with an
+// unspecified IP match any local IP.
+func (s *TransparentServer) isSelf(c net.Conn, dst *net.TCPAddr) bool {
+	addrs := s.ListenAddrs
+	if !s.TPROXY {
+		addrs = append([]net.Addr{c.LocalAddr()}, addrs...)
+	}
+	for _, addr := range addrs {
+		la, ok := addr.(*net.TCPAddr)
+		if !ok || la.Port != dst.Port {
+			continue
+		}
+		if la.IP.Equal(dst.IP) || (la.IP.IsUnspecified() && isLocalIP(dst.IP)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isLocalIP reports whether ip is assigned to this host
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		// assume the worst
+		return true
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
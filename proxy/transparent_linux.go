@@ -0,0 +1,95 @@
+//go:build linux
+// +build linux
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST
+	soOriginalDst = 80
+
+	ipv6Transparent = 75
+)
+
+// ListenTransparent listens on the TCP address addr. If tproxy is set,
+// the socket is marked IP_TRANSPARENT to accept connections redirected
+// with TPROXY which requires CAP_NET_ADMIN.
+func ListenTransparent(addr string, tproxy bool) (net.Listener, error) {
+	var lc net.ListenConfig
+	if tproxy {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var err error
+			cerr := c.Control(func(fd uintptr) {
+				if err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err != nil {
+					return
+				}
+				if network == "tcp6" {
+					err = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+				}
+			})
+			if cerr != nil {
+				return cerr
+			}
+			return err
+		}
+	}
+
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// originalDst returns the destination of a connection
+// redirected with iptables/nftables REDIRECT
+func originalDst(c net.Conn) (*net.TCPAddr, error) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("original destination: not a tcp connection")
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	v4 := tc.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+	var dst *net.TCPAddr
+	cerr := raw.Control(func(fd uintptr) {
+		if v4 {
+			// sockaddr_in fits in an ipv6_mreq
+			var mreq *syscall.IPv6Mreq
+			if mreq, err = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst); err != nil {
+				return
+			}
+			sa := mreq.Multiaddr
+			dst = &net.TCPAddr{
+				IP:   net.IPv4(sa[4], sa[5], sa[6], sa[7]),
+				Port: int(sa[2])<<8 | int(sa[3]),
+			}
+			return
+		}
+
+		// sockaddr_in6 fits in an ip6_mtuinfo
+		var info *syscall.IPv6MTUInfo
+		if info, err = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst); err != nil {
+			return
+		}
+		port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+		dst = &net.TCPAddr{
+			IP:   net.IP(info.Addr.Addr[:]),
+			Port: int(port[0])<<8 | int(port[1]),
+		}
+	})
+	if cerr != nil {
+		return nil, cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return dst, nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+var errTransparentNotAvail = errors.New("transparent proxying is only supported on linux")
+
+func ListenTransparent(addr string, tproxy bool) (net.Listener, error) {
+	return nil, errTransparentNotAvail
+}
+
+func originalDst(c net.Conn) (*net.TCPAddr, error) {
+	return nil, errTransparentNotAvail
+}
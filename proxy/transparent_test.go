@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestTransparentServer(t *testing.T) {
+	addrc := make(chan string, 1)
+	s := &TransparentServer{
+		Tunneler: TunnelerFunc(func(ctx context.Context, clientConn *Conn, network, addr string) {
+			defer clientConn.Close()
+			addrc <- addr
+			clientConn.WriteHeader(200)
+			io.Copy(clientConn, clientConn)
+		}),
+		TPROXY: true,
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go s.Serve(l)
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+
+	t.Run("sni", func(t *testing.T) {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		// the handshake fails once echoed
+		go tls.Client(c, &tls.Config{ServerName: "example.com"}).Handshake()
+		if addr := <-addrc; addr != "example.com:"+port {
+			t.Fatalf("addr = %s, wanted example.com:%s", addr, port)
+		}
+	})
+
+	t.Run("no_tls", func(t *testing.T) {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		c.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		if addr := <-addrc; addr != "127.0.0.1:"+port {
+			t.Fatalf("addr = %s, wanted 127.0.0.1:%s", addr, port)
+		}
+
+		// peeked bytes are replayed
+		buf := make([]byte, 3)
+		if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "GET" {
+			t.Fatalf("got %q %v, want GET", buf, err)
+		}
+	})
+
+	t.Run("redirected", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go (&TransparentServer{
+			Tunneler: s.Tunneler,
+			originalDst: func(net.Conn) (*net.TCPAddr, error) {
+				return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 80}, nil
+			},
+		}).Serve(l)
+
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		c.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		if addr := <-addrc; addr != "192.0.2.1:80" {
+			t.Fatalf("addr = %s, wanted 192.0.2.1:80", addr)
+		}
+	})
+
+	t.Run("tproxy_listener", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go (&TransparentServer{
+			Tunneler:    s.Tunneler,
+			TPROXY:      true,
+			ListenAddrs: []net.Addr{l.Addr()},
+		}).Serve(l)
+
+		// the destination is the listener itself
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		if _, err := c.Read(make([]byte, 1)); err == nil {
+			t.Fatal("got nil, want closed connection")
+		}
+	})
+
+	// connections that reach the proxy directly or are redirected
+	// to one of its listeners would make it connect to itself
+	for _, test := range []struct {
+		name        string
+		listenAddrs []net.Addr
+		dst         func(c net.Conn) *net.TCPAddr
+	}{
+		{
+			name: "not_redirected",
+			dst: func(c net.Conn) *net.TCPAddr {
+				// conntrack reports the local address
+				return c.LocalAddr().(*net.TCPAddr)
+			},
+		},
+		{
+			name:        "listener",
+			listenAddrs: []net.Addr{&net.TCPAddr{IP: net.IPv4zero, Port: 8080}},
+			dst: func(net.Conn) *net.TCPAddr {
+				return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080}
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			go (&TransparentServer{
+				Tunneler:    s.Tunneler,
+				ListenAddrs: test.listenAddrs,
+				originalDst: func(c net.Conn) (*net.TCPAddr, error) {
+					return test.dst(c), nil
+				},
+			}).Serve(l)
+
+			c, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			if _, err := c.Read(make([]byte, 1)); err == nil {
+				t.Fatal("got nil, want closed connection")
+			}
+		})
+	}
+}
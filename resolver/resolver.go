@@ -5,6 +5,7 @@ import (
 	"errors"
 	"github.com/miekg/dns"
 	"net"
+	"strings"
 )
 
 // Resolver is an interface for representing
@@ -22,6 +23,15 @@ type Resolver interface {
 	LookupTLSA(ctx context.Context, service, proto, name string) ([]*dns.TLSA, bool, error)
 }
 
+// PTRResolver is implemented by resolvers that
+// can look up the names an IP address maps to.
+type PTRResolver interface {
+	// LookupPTR looks up the PTR records for ip.
+	// It returns the names the address maps to and
+	// whether the lookup was secure.
+	LookupPTR(ctx context.Context, ip net.IP) ([]string, bool, error)
+}
+
 var ErrUnboundNotAvail = errors.New("unbound not available")
 var ErrServFail = errors.New("dns lookup failed (rcode: servfail)")
 
@@ -117,6 +127,31 @@ func (r *DefaultResolver) LookupTLSA(ctx context.Context, service, proto, name s
 	return rrs, result.Secure, nil
 }
 
+// LookupPTR looks up the PTR records for ip.
+// It returns the names the address maps to and
+// whether the lookup was secure.
+func (r *DefaultResolver) LookupPTR(ctx context.Context, ip net.IP) ([]string, bool, error) {
+	arpa, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return nil, false, err
+	}
+
+	result := r.Query(ctx, arpa, dns.TypePTR)
+	if result.Err != nil {
+		return nil, false, result.Err
+	}
+
+	var names []string
+	for _, rr := range result.Records {
+		switch t := rr.(type) {
+		case *dns.PTR:
+			names = append(names, strings.TrimSuffix(t.Ptr, "."))
+		}
+	}
+
+	return names, result.Secure, nil
+}
+
 func parseIP(name string) net.IP {
 	if name == "" {
 		return nil
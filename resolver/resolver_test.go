@@ -444,3 +444,31 @@ func filterNetwork(ips []net.IP, network string) []net.IP {
 
 	return out
 }
+
+func TestResolver_LookupPTR(t *testing.T) {
+	r := DefaultResolver{
+		Query: func(ctx context.Context, qname string, qtype uint16) *DNSResult {
+			if qtype != dns.TypePTR {
+				t.Fatalf("got qtype = %s, want qtype = PTR", dns.TypeToString[qtype])
+			}
+			if qname != "1.2.0.192.in-addr.arpa." {
+				return &DNSResult{Err: ErrServFail}
+			}
+
+			rr, _ := dns.NewRR("1.2.0.192.in-addr.arpa. 300 IN PTR host.example.")
+			return &DNSResult{Records: []dns.RR{rr}, Secure: true}
+		},
+	}
+
+	names, secure, err := r.LookupPTR(context.Background(), net.ParseIP("192.0.2.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !secure || len(names) != 1 || names[0] != "host.example" {
+		t.Fatalf("got %v, secure = %v, want [host.example], secure = true", names, secure)
+	}
+
+	if _, _, err := r.LookupPTR(context.Background(), net.ParseIP("192.0.2.2")); err == nil {
+		t.Fatal("got nil, want error")
+	}
+}
@@ -106,6 +106,7 @@ func NewStub(server string) (*Stub, error) {
 	rrCache[dns.TypeA] = newCache(maxCache)
 	rrCache[dns.TypeAAAA] = newCache(maxCache)
 	rrCache[dns.TypeTLSA] = newCache(maxCache)
+	rrCache[dns.TypePTR] = newCache(maxCache)
 
 	stub := &Stub{
 		rrCache:      rrCache,
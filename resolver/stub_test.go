@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"github.com/miekg/dns"
+	"net"
 	"sync"
 	"testing"
 	"time"
@@ -38,6 +39,23 @@ func TestStub_Verify(t *testing.T) {
 	}
 }
 
+func TestStub_LookupPTR(t *testing.T) {
+	rs, _ := NewStub("0.0.0.0")
+	rs.exchangeFunc = func(ctx context.Context, req *dns.Msg, client *client) (r *dns.Msg, rtt time.Duration, err error) {
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		reply.AuthenticatedData = true
+		rr, _ := dns.NewRR(req.Question[0].Name + " 300 IN PTR host.example.")
+		reply.Answer = []dns.RR{rr}
+		return reply, 0, nil
+	}
+
+	names, secure, err := rs.LookupPTR(context.Background(), net.ParseIP("192.0.2.1"))
+	if err != nil || !secure || len(names) != 1 || names[0] != "host.example" {
+		t.Fatalf("got %v, %v, %v, want [host.example], true, nil", names, secure, err)
+	}
+}
+
 func TestStub_NewStub(t *testing.T) {
 	ad, err := NewStub("https://cloudflare.com")
 	if err != nil {
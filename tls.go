@@ -2,6 +2,7 @@ package letsdane
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"github.com/miekg/dns"
@@ -11,6 +12,9 @@ import (
 
 type tlsError struct {
 	err string
+
+	// cert is the certificate presented by the remote
+	cert *x509.Certificate
 }
 
 func (t *tlsError) Error() string {
@@ -40,6 +44,29 @@ func newTLSConfig(host string, rrs []*dns.TLSA, nameCheck bool) *tls.Config {
 	}
 }
 
+// newPKIXConfig creates a new tls configuration validating
+// the certificate chain against roots (system roots if nil).
+func newPKIXConfig(host string, roots *x509.CertPool) *tls.Config {
+	config := newTLSConfig(host, nil, true)
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		opts := x509.VerifyOptions{
+			DNSName:       cs.ServerName,
+			Roots:         roots,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+
+		if _, err := cs.PeerCertificates[0].Verify(opts); err != nil {
+			return &tlsError{err: fmt.Sprintf("tls: pkix validation failed: %v", err), cert: cs.PeerCertificates[0]}
+		}
+		return nil
+	}
+
+	return config
+}
+
 // verifyConnection returns a function that verifies the given tls connection state using the host and rrs
 func verifyConnection(rrs []*dns.TLSA, nameCheck bool) func(cs tls.ConnectionState) error {
 	return func(cs tls.ConnectionState) error {
@@ -47,7 +74,7 @@ func verifyConnection(rrs []*dns.TLSA, nameCheck bool) func(cs tls.ConnectionSta
 		// https://tools.ietf.org/html/rfc7671
 		if nameCheck {
 			if err := cs.PeerCertificates[0].VerifyHostname(cs.ServerName); err != nil {
-				return &tlsError{err: fmt.Sprintf("tls: %v", err)}
+				return &tlsError{err: fmt.Sprintf("tls: %v", err), cert: cs.PeerCertificates[0]}
 			}
 		}
 
@@ -60,7 +87,7 @@ func verifyConnection(rrs []*dns.TLSA, nameCheck bool) func(cs tls.ConnectionSta
 				return nil
 			}
 		}
-		return &tlsError{err: "tls: dane authentication failed"}
+		return &tlsError{err: "tls: dane authentication failed", cert: cs.PeerCertificates[0]}
 	}
 }
 
@@ -2,8 +2,10 @@ package letsdane
 
 import (
 	"context"
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"github.com/buffrr/letsdane/proxy"
 	"github.com/buffrr/letsdane/resolver"
@@ -14,7 +16,10 @@ import (
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -29,15 +34,137 @@ const (
 
 type Config struct {
 	Certificate    *x509.Certificate
-	PrivateKey     interface{}
+	PrivateKey     crypto.Signer
 	Validity       time.Duration
 	Resolver       resolver.Resolver
 	Constraints    map[string]struct{}
 	SkipNameChecks bool
 	Verbose        bool
 
+	// Permitted if set restricts DANE to names within these
+	// zones, connections to other names are passed through.
+	// Use with a CA created by NewPermittedAuthority.
+	Permitted map[string]struct{}
+
+	// RequireDANE lists domains (or *.domain wildcards) for which
+	// DANE is mandatory. Tunnels to these are refused if no secure
+	// TLSA records are found instead of being passed through.
+	RequireDANE []string
+
+	// PinMaxAge if set enables learned DANE pinning: hosts that
+	// presented valid DANE authenticated TLS require DANE for
+	// PinMaxAge since they were last seen. PinFile optionally
+	// persists the pins.
+	PinMaxAge time.Duration
+	PinFile   string
+
+	// Bypass lists destinations (domains or *.domain wildcards
+	// optionally followed by :port) that are always passed through
+	// without TLSA lookups or interception e.g. for clients that
+	// pin certificates or use client certificates.
+	Bypass []string
+
+	// StrictPKIX terminates TLS for sites without DANE as well.
+	// The remote is validated against PKIXRoots (system roots if nil)
+	// and a certificate is only issued if validation succeeds.
+	StrictPKIX bool
+	PKIXRoots  *x509.CertPool
+
+	// ErrorPages if set completes the client handshake when the
+	// remote can't be authenticated and serves a page describing
+	// the failure instead of terminating the handshake.
+	ErrorPages bool
+
+	// OverrideURL if set allows users to proceed to a site failing
+	// validation for a limited time from the error page. Overrides
+	// are keyed to the host and the exact certificate presented and
+	// submitted to this url's path served by the proxy. OverrideFile
+	// optionally persists overrides. Requires ErrorPages.
+	OverrideURL  string
+	OverrideFile string
+
+	// ClientIdentities are client certificates presented to
+	// destinations requesting one on the upstream leg.
+	// RequestClientCerts if set requests a certificate from
+	// the browser for destinations with identities mapped
+	// to browser certificates.
+	ClientIdentities   []*ClientIdentity
+	RequestClientCerts bool
+
+	// Successor is an optional CA replacing Certificate
+	// as the issuer once SwitchoverTime is reached.
+	Successor           *x509.Certificate
+	SuccessorPrivateKey crypto.Signer
+	SwitchoverTime      time.Time
+
+	// CRLURL if set is embedded as the CRL distribution point
+	// in issued certificates. Certificates are revoked once their
+	// DANE validation no longer holds and the CRL is served
+	// at this url's path by the proxy.
+	CRLURL string
+
+	// InventoryFile optionally persists the issued certificates
+	// used to build the CRL.
+	InventoryFile string
+
 	// For handling relative urls/non-proxy requests
 	ContentHandler http.Handler
+
+	// ListenCertificate if set serves the proxy over TLS e.g. for
+	// clients configured with an HTTPS proxy. Otherwise ListenNames
+	// if set serves TLS with certificates for these names issued
+	// by the CA.
+	ListenCertificate *tls.Certificate
+	ListenNames       []string
+
+	// SOCKSAddr if set additionally serves SOCKS5 clients on this
+	// address using the same tunneler. SOCKSAuth optionally requires
+	// username/password authentication.
+	SOCKSAddr string
+	SOCKSAuth func(username, password string) bool
+
+	// UpgradeHTTP if set upgrades plain http requests to hosts
+	// with secure TLSA records for port 443 to https, giving DANE
+	// sites an HSTS-like upgrade. Either UpgradeRedirect or
+	// UpgradeFetch.
+	UpgradeHTTP int
+
+	// RequireDNSSEC if set refuses plain http requests to names
+	// whose addresses aren't DNSSEC secure. Forwarded responses
+	// carry the DNSSEC status of the remote's addresses in the
+	// X-DNSSEC-Status header either way.
+	RequireDNSSEC bool
+
+	// Upstream if set is a parent proxy (http, https or socks5 url
+	// with optional credentials) used to reach destinations.
+	// UpstreamRoutes select a parent proxy by destination and
+	// take precedence over Upstream. Names are resolved by the
+	// parent proxy while TLSA lookups and DANE validation
+	// still happen locally.
+	Upstream       *url.URL
+	UpstreamRoutes []*UpstreamRoute
+
+	// TransparentAddr if set additionally serves connections
+	// redirected by the firewall on this address (Linux only).
+	// Their destination is the TLS SNI or the original destination
+	// address. TransparentTPROXY is set for TPROXY redirects instead
+	// of REDIRECT.
+	TransparentAddr   string
+	TransparentTPROXY bool
+
+	// ProxyProtocolNets if set accepts PROXY protocol (v1 and v2)
+	// headers on the proxy and SOCKS listeners from senders such as
+	// load balancers in these networks. Their headers are mandatory
+	// and the client address they carry is used for AllowedNets and
+	// logging. Connections from other senders are served as is.
+	ProxyProtocolNets []*net.IPNet
+
+	// Authenticate if set requires proxy clients to authenticate
+	// with Basic Proxy-Authorization, and SOCKS clients unless
+	// SOCKSAuth is set. The username is logged with each tunnel.
+	// AllowedNets if set restricts clients to these source networks.
+	Authenticate func(username, password string) bool
+	AllowedNets  []*net.IPNet
 }
 
 type tunneler struct {
@@ -45,33 +172,90 @@ type tunneler struct {
 	dialer      *dialer
 	nameChecks  bool
 	constraints map[string]struct{}
+	permitted   map[string]struct{}
+	required    *domainSet
+	pins        *pinStore
+	bypass      *hostPortSet
+	strictPKIX  bool
+	pkixRoots   *x509.CertPool
+	errorPages  bool
+	overrides   *overrideStore
+
+	identities         []*clientIdentity
+	requestClientCerts bool
+
+	// requireDNSSEC refuses plain http to names
+	// whose addresses aren't DNSSEC secure
+	requireDNSSEC bool
 	logger
 }
 
 func (h *tunneler) Tunnel(ctx context.Context, clientConn *proxy.Conn, network, addr string) {
 	defer clientConn.Close()
 
-	addrs, tlsa, err := h.dialer.resolveDANE(ctx, network, addr, h.constraints)
+	// log the client address and identity with each message
+	t := *h
+	if client := clientConn.RemoteAddr(); client != nil {
+		t.logger.prefix += "from " + strings.ReplaceAll(client.String(), "%", "%%") + " "
+	}
+	if identity, ok := proxy.IdentityFromContext(ctx); ok {
+		t.logger.prefix += fmt.Sprintf("(%s) ", strings.ReplaceAll(identity, "%", "%%"))
+	}
+	h = &t
+
+	// require-dane and learned pins take precedence over the bypass list
+	if host, port, err := net.SplitHostPort(addr); err == nil && h.bypass.match(host, port) {
+		required := h.daneRequired(&addrList{Host: host, Port: port})
+		if required == "" {
+			h.bypassTunnel(ctx, clientConn, network, addr)
+			return
+		}
+		h.logf("%s, not bypassed", http.StatusOK, addr, required)
+	}
+
+	addrs, tlsa, err := h.dialer.resolveDANE(ctx, network, addr, h.constraints, h.permitted)
 	if err == errBadHost {
 		h.warnf("bad host", http.StatusBadRequest, addr)
 		clientConn.WriteHeader(http.StatusBadRequest)
 		return
 	}
 	if err != nil {
-		h.warnf("%v", http.StatusBadGateway, addr, err)
+		if required := h.daneRequired(addrs); required != "" {
+			h.warnf("%s, refusing tunnel: %v", http.StatusBadGateway, addr, required, err)
+		} else {
+			h.warnf("%v", http.StatusBadGateway, addr, err)
+		}
 		clientConn.WriteHeader(http.StatusBadGateway)
 		return
 	}
-	if len(addrs.IPs) == 0 {
+	if len(addrs.IPs) == 0 && !h.dialer.routed(addrs.Host) {
 		h.warnf("no such host", http.StatusBadGateway, addr)
 		clientConn.WriteHeader(http.StatusBadGateway)
 		return
 	}
+	reason := "no secure tlsa records found"
 	if !tlsaSupported(tlsa) {
+		if len(tlsa) > 0 {
+			reason = "no supported tlsa usage found"
+		}
 		tlsa = []*dns.TLSA{}
 	}
 
 	if len(tlsa) == 0 {
+		h.revoke(addr, addrs.Host)
+
+		if required := h.daneRequired(addrs); required != "" {
+			h.warnf("%s, refusing tunnel: %s", http.StatusForbidden, addr, required, reason)
+			clientConn.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		// names the CA may not sign are passed through
+		if h.strictPKIX && h.canIssue(addrs.Host) {
+			h.pkixTunnel(ctx, clientConn, network, addr, addrs)
+			return
+		}
+
 		remote, err := h.dialer.dialAddrList(ctx, network, addrs)
 		if err != nil {
 			h.warnf("dial remote host failed: %v", http.StatusBadGateway, addr, err)
@@ -96,22 +280,147 @@ func (h *tunneler) Tunnel(ctx context.Context, clientConn *proxy.Conn, network,
 		return
 	}
 
-	tlsaDomain := addrs.Host
-	if tlsaDomain != hello.ServerName {
-		h.warnf("client sni `%s` does not match tlsa domain `%s`", statusErr, addr, hello.ServerName, tlsaDomain)
+	// clients without sni (e.g. ip literal targets) are
+	// assumed to connect to the CONNECT hostname
+	if hello.ServerName != "" && addrs.Host != hello.ServerName {
+		h.warnf("client sni `%s` does not match tlsa domain `%s`", statusErr, addr, hello.ServerName, addrs.Host)
+		return
+	}
+	if hello.ServerName == "" {
+		h.logf("no client sni, using tlsa domain `%s`", http.StatusOK, addr, addrs.TLSAName)
+	}
+
+	h.interceptTLS(ctx, clientConn, hello, network, addr, addrs, newTLSConfig(addrs.TLSAName, tlsa, h.nameChecks), tlsa)
+}
+
+// canIssue reports whether host is within the name
+// constraints and permitted zones of the CA
+func (h *tunneler) canIssue(host string) bool {
+	return !inConstraints(h.constraints, host) && inPermitted(h.permitted, host)
+}
+
+// pkixTunnel terminates TLS for a site without DANE and issues
+// a certificate only if the remote validates against the PKIX roots.
+// Connections that don't start with a TLS client hello are passed through.
+func (h *tunneler) pkixTunnel(ctx context.Context, clientConn *proxy.Conn, network, addr string, addrs *addrList) {
+	clientConn.WriteHeader(http.StatusOK)
+	hello, err := clientConn.PeekClientHello()
+	if err == io.EOF {
+		return
+	}
+	if err != nil {
+		remote, err := h.dialer.dialAddrList(ctx, network, addrs)
+		if err != nil {
+			h.warnf("dial remote host failed: %v", statusErr, addr, err)
+			return
+		}
+
+		h.logf("no tls client hello, tunnel established %s", http.StatusOK, addr, remote.RemoteAddr().String())
+		clientConn.Copy(remote)
 		return
 	}
 
+	if hello.ServerName != "" && addrs.Host != hello.ServerName {
+		h.warnf("client sni `%s` does not match host `%s`", statusErr, addr, hello.ServerName, addrs.Host)
+		return
+	}
+
+	h.interceptTLS(ctx, clientConn, hello, network, addr, addrs, newPKIXConfig(addrs.Host, h.pkixRoots), nil)
+}
+
+// interceptTLS connects to the remote using config and serves the client
+// with a certificate issued by the proxy once the remote is authenticated.
+// The tlsa records are empty if the remote is authenticated using PKIX.
+func (h *tunneler) interceptTLS(ctx context.Context, clientConn *proxy.Conn, hello *tls.ClientHelloInfo,
+	network, addr string, addrs *addrList, config *tls.Config, tlsa []*dns.TLSA) {
 	alpn := false
-	daneConfig := newTLSConfig(tlsaDomain, tlsa, h.nameChecks)
 	if len(hello.SupportedProtos) > 0 {
-		daneConfig.NextProtos = hello.SupportedProtos
+		config.NextProtos = hello.SupportedProtos
 		alpn = true
 	}
 
-	remote, err := h.dialer.dialTLSContext(ctx, network, addrs, daneConfig)
-	if _, ok := err.(*tlsError); ok {
-		terminateTLSHandshake(clientConn)
+	// the browser certificate selects the upstream identity so the
+	// client handshake must complete before connecting to the remote
+	var clientTLS *tls.Conn
+	var browserCert *x509.Certificate
+	if h.browserCertMapped(addrs.Host, addrs.Port) {
+		clientTLSConfig := h.mitm.configForTLSADomain(addrs.Host, tlsa)
+		clientTLSConfig.ClientAuth = tls.RequestClientCert
+
+		// the remote protocol isn't known yet
+		// so only http/1.1 is negotiated
+		config.NextProtos = nil
+		for _, proto := range hello.SupportedProtos {
+			if proto == "http/1.1" {
+				clientTLSConfig.NextProtos = []string{proto}
+				config.NextProtos = []string{proto}
+			}
+		}
+
+		clientTLS = tls.Server(clientConn, clientTLSConfig)
+		if err := clientTLS.Handshake(); err != nil {
+			if err == io.EOF {
+				return
+			}
+			h.warnf("client handshake failed: %v", statusErr, addr, err)
+			return
+		}
+		if certs := clientTLS.ConnectionState().PeerCertificates; len(certs) > 0 {
+			browserCert = certs[0]
+		}
+	}
+
+	identity := h.clientIdentity(addrs.Host, addrs.Port, browserCert)
+	config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		if identity == nil {
+			h.logf("remote requested a client certificate, none configured", http.StatusOK, addr)
+			return &tls.Certificate{}, nil
+		}
+
+		h.logf("remote requested a client certificate, presenting configured identity", http.StatusOK, addr)
+		return identity, nil
+	}
+
+	var overridden atomic.Bool
+	if h.overrides != nil {
+		verify := config.VerifyConnection
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			err := verify(cs)
+			if err == nil {
+				return nil
+			}
+
+			expires, ok := h.overrides.allowed(addrs.Host, addrs.Port, cs.PeerCertificates[0])
+			if !ok {
+				return err
+			}
+
+			overridden.Store(true)
+			h.auditf("%v, proceeding with user override until %s", statusErr, addr, err, expires.Format(time.RFC3339))
+			return nil
+		}
+	}
+
+	remote, err := h.dialer.dialTLSContext(ctx, network, addrs, config)
+	if tlsErr, ok := err.(*tlsError); ok {
+		h.revoke(addr, addrs.Host)
+		if h.errorPages {
+			h.warnf("dial remote host failed: %v", statusErr, addr, err)
+			f := newValidationFailure(addrs, tlsa, tlsErr)
+			if h.overrides != nil && f.CertSHA256 != "" {
+				f.OverrideURL = h.overrides.url
+				f.OverrideToken = h.overrides.token(f.Host, f.Port, f.CertSHA256)
+			}
+			if clientTLS != nil {
+				serveFailure(clientTLS, f)
+				return
+			}
+			h.serveErrorPage(clientConn, hello, addr, f)
+			return
+		}
+		if clientTLS == nil {
+			terminateTLSHandshake(clientConn)
+		}
 	}
 	if err != nil {
 		h.warnf("dial remote host failed: %v", statusErr, addr, err)
@@ -119,28 +428,103 @@ func (h *tunneler) Tunnel(ctx context.Context, clientConn *proxy.Conn, network,
 	}
 	defer remote.Close()
 
-	// create certificate & negotiate the same protocol
-	// used by the remote server
-	clientTLSConfig := h.mitm.configForTLSADomain(tlsaDomain)
-	if alpn {
-		if serverProto := remote.ConnectionState().NegotiatedProtocol; serverProto != "" {
-			clientTLSConfig.NextProtos = []string{serverProto}
+	kind := "pkix"
+	if overridden.Load() {
+		kind = "overridden"
+	} else if len(tlsa) > 0 {
+		kind = "dane"
+		if err := h.pins.add(addrs.Host, addrs.Port); err != nil {
+			h.warnf("pin: %v", statusErr, addr, err)
 		}
 	}
 
-	clientTLS := tls.Server(clientConn, clientTLSConfig)
-	if err := clientTLS.Handshake(); err != nil {
-		if err == io.EOF {
+	if clientTLS == nil {
+		// create certificate & negotiate the same protocol
+		// used by the remote server
+		clientTLSConfig := h.mitm.configForTLSADomain(addrs.Host, tlsa)
+		if alpn {
+			if serverProto := remote.ConnectionState().NegotiatedProtocol; serverProto != "" {
+				clientTLSConfig.NextProtos = []string{serverProto}
+			}
+		}
+
+		clientTLS = tls.Server(clientConn, clientTLSConfig)
+		if err := clientTLS.Handshake(); err != nil {
+			if err == io.EOF {
+				return
+			}
+			h.warnf("client handshake failed: %v", statusErr, addr, err)
 			return
 		}
-		h.warnf("client handshake failed: %v", statusErr, addr, err)
-		return
 	}
 
-	h.logf("dane tunnel established %s", http.StatusOK, addr, remote.RemoteAddr().String())
+	h.logf("%s tunnel established %s", http.StatusOK, addr, kind, remote.RemoteAddr().String())
 	copyConn(clientTLS, remote)
 }
 
+// bypassTunnel establishes a plain tunnel without TLSA lookups.
+// TLSA records are still looked up in the background to log
+// whether DANE was available.
+func (h *tunneler) bypassTunnel(ctx context.Context, clientConn *proxy.Conn, network, addr string) {
+	go h.logBypassedDANE(network, addr)
+
+	remote, err := h.dialer.dialContext(ctx, network, addr)
+	if err != nil {
+		h.warnf("dial remote host failed: %v", http.StatusBadGateway, addr, err)
+		clientConn.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	h.logf("bypass tunnel established %s", http.StatusOK, addr, remote.RemoteAddr().String())
+	clientConn.WriteHeader(http.StatusOK)
+	clientConn.Copy(remote)
+}
+
+// logBypassedDANE logs if addr has secure TLSA records
+// that are not used because it's in the bypass list
+func (h *tunneler) logBypassedDANE(network, addr string) {
+	host, port, _ := net.SplitHostPort(addr)
+	if net.ParseIP(host) != nil || h.dialer.routed(host) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tlsa, secure, err := h.dialer.resolver.LookupTLSA(ctx, port, network, host)
+	if err != nil || !secure || !tlsaSupported(tlsa) {
+		return
+	}
+
+	h.warnf("dane available but bypassed", http.StatusOK, addr)
+}
+
+// daneRequired returns why DANE is mandatory for the
+// given address or an empty string if it's optional
+func (h *tunneler) daneRequired(addrs *addrList) string {
+	if h.required.match(addrs.Host) {
+		return "dane required by policy"
+	}
+	if expires, ok := h.pins.pinned(addrs.Host, addrs.Port); ok {
+		return "dane pinned until " + expires.Format(time.RFC3339)
+	}
+
+	return ""
+}
+
+// revoke revokes certificates issued for host
+// once its DANE validation no longer holds
+func (h *tunneler) revoke(addr, host string) {
+	n, err := h.mitm.revoke(host, reasonUnspecified)
+	if err != nil {
+		h.warnf("revoke certificates: %v", statusErr, addr, err)
+		return
+	}
+	if n > 0 {
+		h.warnf("revoked %d certificate(s) issued for %s", statusErr, addr, n, host)
+	}
+}
+
 func (c *Config) NewHandler() (*proxy.Handler, error) {
 	p := &proxy.Handler{}
 
@@ -148,11 +532,63 @@ func (c *Config) NewHandler() (*proxy.Handler, error) {
 	if err != nil {
 		return nil, err
 	}
+	if c.Successor != nil {
+		mitm.setSuccessor(c.Successor, c.SuccessorPrivateKey, c.SwitchoverTime)
+	}
+
+	var overrides *overrideStore
+	if c.OverrideURL != "" {
+		if !c.ErrorPages {
+			return nil, errors.New("overrides require error pages")
+		}
+		if overrides, err = loadOverrideStore(c.OverrideFile, c.OverrideURL); err != nil {
+			return nil, err
+		}
+	}
+
+	content, err := c.contentHandler(mitm, overrides)
+	if err != nil {
+		return nil, err
+	}
+
+	required, err := newDomainSet(c.RequireDANE)
+	if err != nil {
+		return nil, err
+	}
+
+	bypass, err := newHostPortSet(c.Bypass)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range c.Bypass {
+		domain := strings.TrimPrefix(strings.TrimSpace(p), "*.")
+		if i := strings.LastIndexByte(domain, ':'); i >= 0 {
+			domain = domain[:i]
+		}
+		if required.match(domain) {
+			log.Printf("[WARN] bypass: %s is also in the require-dane list, dane will be required", p)
+		}
+	}
+
+	identities, err := newClientIdentities(c.ClientIdentities)
+	if err != nil {
+		return nil, err
+	}
+
+	var pins *pinStore
+	if c.PinMaxAge > 0 {
+		if pins, err = loadPinStore(c.PinFile, c.PinMaxAge); err != nil {
+			return nil, err
+		}
+	}
 
 	dialer := newDialer()
 	dialer.resolver = c.Resolver
+	if dialer.upstreams, err = newUpstreams(c.Upstream, c.UpstreamRoutes, dialer.net.DialContext); err != nil {
+		return nil, err
+	}
 
-	p.Tunneler = &tunneler{
+	tun := &tunneler{
 		mitm:       mitm,
 		dialer:     dialer,
 		nameChecks: !c.SkipNameChecks,
@@ -161,19 +597,45 @@ func (c *Config) NewHandler() (*proxy.Handler, error) {
 			verbose: c.Verbose,
 		},
 		constraints: c.Constraints,
+		permitted:   c.Permitted,
+		required:    required,
+		pins:        pins,
+		bypass:      bypass,
+		strictPKIX:  c.StrictPKIX,
+		pkixRoots:   c.PKIXRoots,
+		errorPages:  c.ErrorPages,
+		overrides:   overrides,
+
+		identities:         identities,
+		requestClientCerts: c.RequestClientCerts,
+		requireDNSSEC:      c.RequireDNSSEC,
 	}
+	p.Tunneler = tun
 
 	httpProxy := &httputil.ReverseProxy{
 		Director:  func(req *http.Request) {},
-		Transport: httpOnlyRoundTripper(dialer),
+		Transport: forwardRoundTripper(tun),
+		ModifyResponse: func(resp *http.Response) error {
+			// only the proxy reports the dnssec status
+			resp.Header.Del(dnssecStatusHeader)
+			return nil
+		},
 		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
-			httpError(w, err.Error(), http.StatusBadGateway)
+			code := http.StatusBadGateway
+			if errors.Is(err, errDNSSECRequired) {
+				code = http.StatusForbidden
+			}
+			httpError(w, err.Error(), code)
 			if rws, ok := w.(*rwStatusReader); ok {
 				rws.err = err
 			}
 		},
 	}
 
+	p.Authenticate = c.Authenticate
+	p.Realm = "letsdane"
+	p.AllowedNets = c.AllowedNets
+
 	p.NonConnect = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		rws := &rwStatusReader{ResponseWriter: rw}
 		defer func() {
@@ -182,6 +644,10 @@ func (c *Config) NewHandler() (*proxy.Handler, error) {
 			}
 
 			u := strconv.Quote(fmt.Sprintf("%s://%s%s", req.URL.Scheme, req.URL.Host, req.URL.Path))
+			u += " from " + req.RemoteAddr
+			if identity, ok := proxy.IdentityFromContext(req.Context()); ok {
+				u += fmt.Sprintf(" (%s)", identity)
+			}
 			if rws.err != nil {
 				log.Printf("[WARN] http: %s %s %s: %v", statusErr, req.Method, u, rws.err)
 				return
@@ -190,29 +656,99 @@ func (c *Config) NewHandler() (*proxy.Handler, error) {
 		}()
 
 		if !req.URL.IsAbs() {
-			if c.ContentHandler != nil {
-				c.ContentHandler.ServeHTTP(rws, req)
-				return
-			}
-
-			httpError(rws, "You cannot use this proxy to make non-proxy requests", http.StatusBadRequest)
+			content.ServeHTTP(rws, req)
 			return
 		}
 		if req.URL.Scheme == "" {
 			httpError(rws, "Missing protocol scheme", http.StatusBadRequest)
 			return
 		}
-		if req.URL.Scheme != "http" {
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
 			httpError(rws, "Unsupported scheme", http.StatusNotImplemented)
 			return
 		}
 
-		httpProxy.ServeHTTP(rws, req)
+		if c.UpgradeHTTP != UpgradeNone && tun.daneUpgrade(req) {
+			u := *req.URL
+			u.Scheme, u.Host = "https", u.Hostname()
+			if c.UpgradeHTTP == UpgradeRedirect {
+				http.Redirect(rws, req, u.String(), http.StatusTemporaryRedirect)
+				return
+			}
+
+			if c.Verbose {
+				log.Printf("[INFO] http: upgrading %s to https", strconv.Quote(req.URL.Host))
+			}
+			req.URL = &u
+			req.Host = u.Host
+		}
+
+		httpProxy.ServeHTTP(rws, withDNSSECStatus(rws, req))
 	})
 
 	return p, nil
 }
 
+// contentHandler returns the handler used for relative urls/non-proxy requests
+func (c *Config) contentHandler(mitm *mitmConfig, overrides *overrideStore) (http.Handler, error) {
+	content := c.ContentHandler
+	if content == nil {
+		content = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			httpError(w, "You cannot use this proxy to make non-proxy requests", http.StatusBadRequest)
+		})
+	}
+
+	if c.CRLURL == "" && overrides == nil {
+		return content, nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", content)
+
+	if c.CRLURL != "" {
+		p, err := urlPath(c.CRLURL)
+		if err != nil {
+			return nil, fmt.Errorf("bad crl url: %v", err)
+		}
+
+		inv, err := loadInventory(c.InventoryFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := mitm.enableCRL(c.CRLURL, inv); err != nil {
+			return nil, err
+		}
+
+		mux.HandleFunc(p+"/", mitm.serveCRL)
+	}
+
+	if overrides != nil {
+		p, err := urlPath(overrides.url)
+		if err != nil {
+			return nil, fmt.Errorf("bad override url: %v", err)
+		}
+
+		mux.Handle(p, overrides)
+	}
+
+	return mux, nil
+}
+
+// urlPath returns the path of a url served by the proxy
+func urlPath(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+
+	p := strings.TrimSuffix(u.Path, "/")
+	if p == "" {
+		return "", errors.New("path must not be empty")
+	}
+
+	return p, nil
+}
+
 func httpError(w http.ResponseWriter, error string, code int) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
@@ -238,7 +774,129 @@ func (c *Config) Run(addr string) error {
 		return err
 	}
 
-	return http.ListenAndServe(addr, h)
+	if addr == "" {
+		addr = ":http"
+	}
+	ln, err := c.listen(addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	// addresses of the proxy itself which
+	// redirected connections must not reach
+	listenAddrs := []net.Addr{ln.Addr()}
+
+	errc := make(chan error, 3)
+	if c.SOCKSAddr != "" {
+		ln, err := c.listen(c.SOCKSAddr)
+		if err != nil {
+			return err
+		}
+		defer ln.Close()
+		listenAddrs = append(listenAddrs, ln.Addr())
+
+		socks := &proxy.SOCKSServer{
+			Tunneler:     h.Tunneler,
+			Authenticate: c.SOCKSAuth,
+			AllowedNets:  c.AllowedNets,
+		}
+		if socks.Authenticate == nil {
+			socks.Authenticate = c.Authenticate
+		}
+		go func() {
+			errc <- socks.Serve(ln)
+		}()
+	}
+
+	if c.TransparentAddr != "" {
+		ln, err := proxy.ListenTransparent(c.TransparentAddr, c.TransparentTPROXY)
+		if err != nil {
+			return err
+		}
+		defer ln.Close()
+
+		transparent := &proxy.TransparentServer{
+			Tunneler:    h.Tunneler,
+			TPROXY:      c.TransparentTPROXY,
+			AllowedNets: c.AllowedNets,
+			ListenAddrs: append(listenAddrs, ln.Addr()),
+		}
+		go func() {
+			errc <- transparent.Serve(ln)
+		}()
+	}
+
+	srv := newServer(addr, h)
+	go func() {
+		if c.ListenCertificate == nil && len(c.ListenNames) == 0 {
+			errc <- srv.Serve(ln)
+			return
+		}
+
+		srv.TLSConfig = c.listenTLSConfig(h.Tunneler.(*tunneler).mitm)
+		errc <- srv.ServeTLS(ln, "", "")
+	}()
+
+	return <-errc
+}
+
+// listen listens on the TCP address addr accepting
+// PROXY protocol headers from ProxyProtocolNets
+func (c *Config) listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil || c.ProxyProtocolNets == nil {
+		return ln, err
+	}
+
+	return &proxy.ProxyProtoListener{Listener: ln, Trusted: c.ProxyProtocolNets}, nil
+}
+
+// listenTLSConfig returns the config used to serve the
+// proxy over TLS with ALPN for HTTP/1.1 and HTTP/2
+func (c *Config) listenTLSConfig(mitm *mitmConfig) *tls.Config {
+	config := &tls.Config{
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if c.ListenCertificate != nil {
+		config.Certificates = []tls.Certificate{*c.ListenCertificate}
+		return config
+	}
+
+	names := make(map[string]struct{})
+	for _, name := range c.ListenNames {
+		names[strings.ToLower(name)] = struct{}{}
+	}
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		name := strings.ToLower(hello.ServerName)
+		if name == "" {
+			name = strings.ToLower(c.ListenNames[0])
+		}
+		if _, ok := names[name]; !ok {
+			return nil, fmt.Errorf("proxy listener: unknown server name `%s`", hello.ServerName)
+		}
+
+		return mitm.listenCert(name)
+	}
+
+	return config
+}
+
+// newServer returns a server accepting HTTP/1.1 as well as HTTP/2
+// with prior knowledge (h2c) or negotiated over TLS. Each HTTP/2
+// CONNECT stream becomes a tunnel so a single client connection
+// can multiplex all its tunnels.
+func newServer(addr string, h http.Handler) *http.Server {
+	protocols := &http.Protocols{}
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+
+	return &http.Server{
+		Addr:      addr,
+		Handler:   h,
+		Protocols: protocols,
+	}
 }
 
 func copyConn(dst net.Conn, src net.Conn) {
@@ -276,6 +934,29 @@ func inConstraints(constraints map[string]struct{}, domain string) bool {
 	return ok
 }
 
+// inPermitted checks if a domain is within one of the permitted
+// zones. All domains are permitted if zones is nil.
+func inPermitted(zones map[string]struct{}, domain string) bool {
+	if zones == nil {
+		return true
+	}
+
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	for domain != "" {
+		if _, ok := zones[domain]; ok {
+			return true
+		}
+
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+
+	return false
+}
+
 type logger struct {
 	prefix  string
 	verbose bool
@@ -290,3 +971,7 @@ func (l logger) logf(format string, args ...interface{}) {
 func (l logger) warnf(format string, args ...interface{}) {
 	log.Printf("[WARN] "+l.prefix+format, args...)
 }
+
+func (l logger) auditf(format string, args ...interface{}) {
+	log.Printf("[AUDIT] "+l.prefix+format, args...)
+}
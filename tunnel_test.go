@@ -3,8 +3,11 @@ package letsdane
 import (
 	"bufio"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -16,6 +19,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/buffrr/letsdane/proxy"
 	"github.com/miekg/dns"
 )
 
@@ -82,7 +86,7 @@ func TestNonConnectHandler(t *testing.T) {
 		{
 			name:     "unsupported_scheme",
 			wantCode: http.StatusNotImplemented,
-			uri:      "https://example.com",
+			uri:      "ftp://example.com",
 			host:     "example.com",
 		},
 		{
@@ -126,6 +130,211 @@ func TestNonConnectHandler(t *testing.T) {
 	}
 }
 
+func TestNonConnectHTTPS(t *testing.T) {
+	targetSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("foo"))
+	}))
+	defer targetSrv.Close()
+
+	ip, port, _ := net.SplitHostPort(targetSrv.Listener.Addr().String())
+	_, proxyConfig := newProxyTestConfig(t)
+	proxyConfig.RequireDANE = []string{"required.example.com"}
+	proxyConfig.Resolver = &testResolver{
+		lookupIP: func(ctx context.Context, network, host string) ([]net.IP, bool, error) {
+			return []net.IP{net.ParseIP(ip)}, true, nil
+		},
+		lookupTLSA: func(ctx context.Context, service, proto, name string) ([]*dns.TLSA, bool, error) {
+			switch name {
+			case "example.com":
+				return newTLSA(3, 1, 1, targetSrv.Certificate()), true, nil
+			case "mismatch.example.com":
+				return newTLSA(3, 1, 1, strings.Repeat("00", 32)), true, nil
+			}
+			return nil, true, nil
+		},
+	}
+
+	proxyHandler, err := proxyConfig.NewHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxySrv := httptest.NewServer(proxyHandler)
+	defer proxySrv.Close()
+
+	for _, test := range []struct {
+		host     string
+		wantCode int
+	}{
+		{"example.com", http.StatusOK},
+		{"mismatch.example.com", http.StatusBadGateway},
+		// the test server's certificate isn't trusted by the system roots
+		{"www.example.com", http.StatusBadGateway},
+		{"required.example.com", http.StatusBadGateway},
+	} {
+		t.Run(test.host, func(t *testing.T) {
+			conn, err := net.Dial("tcp", proxySrv.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			addr := net.JoinHostPort(test.host, port)
+			fmt.Fprintf(conn, "GET https://%s/ HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", addr, addr)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != test.wantCode {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, test.wantCode)
+			}
+			if test.wantCode != http.StatusOK {
+				return
+			}
+			if body, _ := io.ReadAll(resp.Body); string(body) != "foo" {
+				t.Fatalf("got body %q, want foo", body)
+			}
+		})
+	}
+}
+
+func TestNonConnectUpgrade(t *testing.T) {
+	targetSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("foo"))
+	}))
+	defer targetSrv.Close()
+
+	// parent proxy reaching port 443 at the test server
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go (&proxy.SOCKSServer{
+		Tunneler: proxy.TunnelerFunc(func(ctx context.Context, clientConn *proxy.Conn, network, addr string) {
+			defer clientConn.Close()
+			remote, err := net.Dial("tcp", targetSrv.Listener.Addr().String())
+			if err != nil || !strings.HasSuffix(addr, ":443") {
+				clientConn.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			clientConn.WriteHeader(http.StatusOK)
+			clientConn.Copy(remote)
+		}),
+	}).Serve(l)
+
+	_, proxyConfig := newProxyTestConfig(t)
+	proxyConfig.Upstream = &url.URL{Scheme: "socks5", Host: l.Addr().String()}
+	proxyConfig.Resolver = &testResolver{
+		lookupIP: func(ctx context.Context, network, host string) ([]net.IP, bool, error) {
+			return []net.IP{net.ParseIP("192.0.2.1")}, true, nil
+		},
+		lookupTLSA: func(ctx context.Context, service, proto, name string) ([]*dns.TLSA, bool, error) {
+			if name == "example.com" && service == "443" {
+				return newTLSA(3, 1, 1, targetSrv.Certificate()), true, nil
+			}
+			return nil, true, nil
+		},
+	}
+
+	get := func(t *testing.T, handler http.Handler, uri string) *http.Response {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, uri, nil)
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw.Result()
+	}
+
+	t.Run("redirect", func(t *testing.T) {
+		proxyConfig.UpgradeHTTP = UpgradeRedirect
+		handler, err := proxyConfig.NewHandler()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp := get(t, handler, "http://example.com/path?q=1")
+		if resp.StatusCode != http.StatusTemporaryRedirect {
+			t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusTemporaryRedirect)
+		}
+		if loc := resp.Header.Get("Location"); loc != "https://example.com/path?q=1" {
+			t.Fatalf("got location %s, want https://example.com/path?q=1", loc)
+		}
+
+		// other ports and hosts without tlsa aren't upgraded
+		for _, uri := range []string{"http://example.com:8080/", "http://www.example.com/"} {
+			if resp := get(t, handler, uri); resp.StatusCode == http.StatusTemporaryRedirect {
+				t.Fatalf("%s: got a redirect, want none", uri)
+			}
+		}
+	})
+
+	t.Run("fetch", func(t *testing.T) {
+		proxyConfig.UpgradeHTTP = UpgradeFetch
+		handler, err := proxyConfig.NewHandler()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp := get(t, handler, "http://example.com/")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+		}
+		if body, _ := io.ReadAll(resp.Body); string(body) != "foo" {
+			t.Fatalf("got body %q, want foo", body)
+		}
+	})
+}
+
+func TestNonConnectDNSSEC(t *testing.T) {
+	targetSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// spoofed status must not reach the client
+		w.Header().Set("X-DNSSEC-Status", "secure")
+		w.Write([]byte("foo"))
+	}))
+	defer targetSrv.Close()
+
+	ip, port, _ := net.SplitHostPort(targetSrv.Listener.Addr().String())
+	_, proxyConfig := newProxyTestConfig(t)
+	proxyConfig.Resolver = &testResolver{
+		lookupIP: func(ctx context.Context, network, host string) ([]net.IP, bool, error) {
+			return []net.IP{net.ParseIP(ip)}, host == "secure.example", nil
+		},
+	}
+
+	for _, test := range []struct {
+		name          string
+		host          string
+		requireDNSSEC bool
+		wantCode      int
+		wantStatus    string
+	}{
+		{"secure", "secure.example", false, http.StatusOK, "secure"},
+		{"insecure", "insecure.example", false, http.StatusOK, "insecure"},
+		{"required_secure", "secure.example", true, http.StatusOK, "secure"},
+		{"required_insecure", "insecure.example", true, http.StatusForbidden, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			proxyConfig.RequireDNSSEC = test.requireDNSSEC
+			handler, err := proxyConfig.NewHandler()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://"+net.JoinHostPort(test.host, port)+"/", nil)
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+
+			if rw.Code != test.wantCode {
+				t.Fatalf("got status %d, want %d", rw.Code, test.wantCode)
+			}
+			if got := rw.Header().Values("X-DNSSEC-Status"); test.wantStatus != "" && (len(got) != 1 || got[0] != test.wantStatus) {
+				t.Fatalf("got dnssec status %v, want %s", got, test.wantStatus)
+			}
+		})
+	}
+}
+
 func TestHandlerTLS(t *testing.T) {
 	resolver := &testResolver{}
 	targetSrv := httptest.NewUnstartedServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
@@ -168,9 +377,15 @@ func TestHandlerTLS(t *testing.T) {
 		ip           []net.IP
 		tlsa         []*dns.TLSA
 		tlsaInsecure bool
+		ptr          []string // names the ip maps to
+		ptrInsecure  bool
 		store        *x509.CertPool
 		fail         bool // whether the request should fail
 		constraints  bool
+		permitted    bool
+		required     bool
+		bypass       bool
+		pkixRoots    *x509.CertPool // enables strict pkix
 		nameCheck    bool
 	}{
 		{
@@ -200,6 +415,27 @@ func TestHandlerTLS(t *testing.T) {
 			store: daneStore,
 			fail:  true,
 		},
+		{
+			name:  "ip_ptr_tlsa",
+			host:  targetIP,
+			port:  targetPort,
+			ip:    []net.IP{net.ParseIP(targetIP)},
+			tlsa:  newTLSA(3, 1, 1, targetSrv.Certificate()),
+			ptr:   []string{"example.com"},
+			store: daneStore,
+			fail:  false,
+		},
+		{
+			name:        "ip_ptr_insecure",
+			host:        targetIP,
+			port:        targetPort,
+			ip:          []net.IP{net.ParseIP(targetIP)},
+			tlsa:        newTLSA(3, 1, 1, targetSrv.Certificate()),
+			ptr:         []string{"example.com"},
+			ptrInsecure: true,
+			store:       daneStore,
+			fail:        true,
+		},
 		{
 			name:  "no_tlsa",
 			host:  "example.com",
@@ -324,6 +560,181 @@ func TestHandlerTLS(t *testing.T) {
 			fail:        false,
 			constraints: true,
 		},
+		{
+			name:      "name_not_permitted",
+			host:      "example.com",
+			port:      targetPort,
+			ip:        []net.IP{net.ParseIP(targetIP)},
+			tlsa:      newTLSA(3, 1, 1, targetSrv.Certificate()),
+			store:     webPKIStore,
+			fail:      false, // should ignore tlsa
+			permitted: true,
+		},
+		{
+			name:      "name_permitted",
+			host:      "bar.3b",
+			port:      targetPort,
+			ip:        []net.IP{net.ParseIP(targetIP)},
+			tlsa:      newTLSA(3, 1, 1, targetSrv.Certificate()),
+			store:     daneStore,
+			fail:      false,
+			permitted: true,
+		},
+		{
+			name:     "dane_required_no_tlsa",
+			host:     "example.com",
+			port:     targetPort,
+			ip:       []net.IP{net.ParseIP(targetIP)},
+			tlsa:     []*dns.TLSA{},
+			store:    webPKIStore,
+			fail:     true,
+			required: true,
+		},
+		{
+			name:         "dane_required_tlsa_insecure",
+			host:         "example.com",
+			port:         targetPort,
+			ip:           []net.IP{net.ParseIP(targetIP)},
+			tlsa:         newTLSA(3, 1, 1, targetSrv.Certificate()),
+			tlsaInsecure: true,
+			store:        webPKIStore,
+			fail:         true,
+			required:     true,
+		},
+		{
+			name:     "dane_required_unsupported_usage",
+			host:     "example.com",
+			port:     targetPort,
+			ip:       []net.IP{net.ParseIP(targetIP)},
+			tlsa:     newTLSA(4, 1, 1, targetSrv.Certificate()),
+			store:    webPKIStore,
+			fail:     true,
+			required: true,
+		},
+		{
+			name:     "dane_required_dane_ee",
+			host:     "example.com",
+			port:     targetPort,
+			ip:       []net.IP{net.ParseIP(targetIP)},
+			tlsa:     newTLSA(3, 1, 1, targetSrv.Certificate()),
+			store:    daneStore,
+			fail:     false,
+			required: true,
+		},
+		{
+			name:   "bypass_dane",
+			host:   "example.com",
+			port:   targetPort,
+			ip:     []net.IP{net.ParseIP(targetIP)},
+			tlsa:   newTLSA(3, 1, 1, targetSrv.Certificate()),
+			store:  webPKIStore,
+			fail:   false, // should ignore tlsa
+			bypass: true,
+		},
+		{
+			name:   "bypass_tlsa_lookup_fail",
+			host:   "example.com",
+			port:   targetPort,
+			ip:     []net.IP{net.ParseIP(targetIP)},
+			tlsa:   nil,
+			store:  webPKIStore,
+			fail:   false,
+			bypass: true,
+		},
+		{
+			name:   "bypass_other_port",
+			host:   "foo.example.com",
+			port:   targetPort,
+			ip:     []net.IP{net.ParseIP(targetIP)},
+			tlsa:   newTLSA(3, 1, 1, targetSrv.Certificate()),
+			store:  daneStore,
+			fail:   false,
+			bypass: true,
+		},
+		{
+			name:     "bypass_dane_required_no_tlsa",
+			host:     "example.com",
+			port:     targetPort,
+			ip:       []net.IP{net.ParseIP(targetIP)},
+			tlsa:     []*dns.TLSA{},
+			store:    webPKIStore,
+			fail:     true, // require-dane takes precedence
+			required: true,
+			bypass:   true,
+		},
+		{
+			name:     "bypass_dane_required_dane",
+			host:     "example.com",
+			port:     targetPort,
+			ip:       []net.IP{net.ParseIP(targetIP)},
+			tlsa:     newTLSA(3, 1, 1, targetSrv.Certificate()),
+			store:    daneStore,
+			fail:     false,
+			required: true,
+			bypass:   true,
+		},
+		{
+			name:      "strict_pkix",
+			host:      "example.com",
+			port:      targetPort,
+			ip:        []net.IP{net.ParseIP(targetIP)},
+			tlsa:      []*dns.TLSA{},
+			store:     daneStore,
+			fail:      false,
+			pkixRoots: webPKIStore,
+		},
+		{
+			name:      "strict_pkix_untrusted_root",
+			host:      "example.com",
+			port:      targetPort,
+			ip:        []net.IP{net.ParseIP(targetIP)},
+			tlsa:      []*dns.TLSA{},
+			store:     daneStore,
+			fail:      true,
+			pkixRoots: x509.NewCertPool(),
+		},
+		{
+			name:      "strict_pkix_bad_name",
+			host:      "foo.bar",
+			port:      targetPort,
+			ip:        []net.IP{net.ParseIP(targetIP)},
+			tlsa:      []*dns.TLSA{},
+			store:     daneStore,
+			fail:      true,
+			pkixRoots: webPKIStore,
+		},
+		{
+			name:        "strict_pkix_in_constraints",
+			host:        "example.com",
+			port:        targetPort,
+			ip:          []net.IP{net.ParseIP(targetIP)},
+			tlsa:        []*dns.TLSA{},
+			store:       webPKIStore,
+			fail:        false, // passed through
+			constraints: true,
+			pkixRoots:   webPKIStore,
+		},
+		{
+			name:      "strict_pkix_not_permitted",
+			host:      "example.com",
+			port:      targetPort,
+			ip:        []net.IP{net.ParseIP(targetIP)},
+			tlsa:      []*dns.TLSA{},
+			store:     webPKIStore,
+			fail:      false, // passed through
+			permitted: true,
+			pkixRoots: webPKIStore,
+		},
+		{
+			name:      "strict_pkix_dane",
+			host:      "example.com",
+			port:      targetPort,
+			ip:        []net.IP{net.ParseIP(targetIP)},
+			tlsa:      newTLSA(3, 1, 1, targetSrv.Certificate()),
+			store:     daneStore,
+			fail:      false,
+			pkixRoots: x509.NewCertPool(),
+		},
 	}
 
 	for _, testReq := range testRequests {
@@ -334,6 +745,23 @@ func TestHandlerTLS(t *testing.T) {
 			} else {
 				proxyHandler.Tunneler.(*tunneler).constraints = nil
 			}
+			if testReq.permitted {
+				proxyHandler.Tunneler.(*tunneler).permitted = permittedTest
+			} else {
+				proxyHandler.Tunneler.(*tunneler).permitted = nil
+			}
+			if testReq.required {
+				proxyHandler.Tunneler.(*tunneler).required = requiredTest
+			} else {
+				proxyHandler.Tunneler.(*tunneler).required = nil
+			}
+			proxyHandler.Tunneler.(*tunneler).strictPKIX = testReq.pkixRoots != nil
+			proxyHandler.Tunneler.(*tunneler).pkixRoots = testReq.pkixRoots
+			if testReq.bypass {
+				proxyHandler.Tunneler.(*tunneler).bypass, _ = newHostPortSet([]string{"example.com:" + targetPort, "*.example.com:1"})
+			} else {
+				proxyHandler.Tunneler.(*tunneler).bypass = nil
+			}
 
 			// create an http transport that acts as a client using the proxySrv server
 			tr := &http.Transport{
@@ -350,12 +778,22 @@ func TestHandlerTLS(t *testing.T) {
 				}
 				return nil, false, errors.New("no such host")
 			}
+			tlsaName := testReq.host
+			if len(testReq.ptr) > 0 {
+				tlsaName = testReq.ptr[0]
+			}
 			resolver.lookupTLSA = func(ctx context.Context, service, proto, name string) ([]*dns.TLSA, bool, error) {
-				if testReq.tlsa != nil && name == testReq.host && service == testReq.port && proto == "tcp" {
+				if testReq.tlsa != nil && name == tlsaName && service == testReq.port && proto == "tcp" {
 					return testReq.tlsa, !testReq.tlsaInsecure, nil
 				}
 				return nil, false, errors.New("no tlsa record found")
 			}
+			resolver.lookupPTR = func(ctx context.Context, ip net.IP) ([]string, bool, error) {
+				if testReq.ptr != nil && ip.String() == testReq.host {
+					return testReq.ptr, !testReq.ptrInsecure, nil
+				}
+				return nil, false, errors.New("no ptr record found")
+			}
 
 			req, _ := http.NewRequest("GET", fmt.Sprintf("https://%s:%s", testReq.host, testReq.port), nil)
 			resp, err := tr.RoundTrip(req)
@@ -379,9 +817,232 @@ func TestHandlerTLS(t *testing.T) {
 		})
 	}
 
+	t.Run("dane_pinned", func(t *testing.T) {
+		tun := proxyHandler.Tunneler.(*tunneler)
+		tun.nameChecks = true
+		tun.constraints = nil
+		tun.permitted = nil
+		tun.required = nil
+		tun.bypass = nil
+		tun.strictPKIX = false
+		tun.pins, _ = loadPinStore("", time.Hour)
+		defer func() { tun.pins = nil }()
+
+		secure := true
+		resolver.lookupIP = func(ctx context.Context, network, host string) ([]net.IP, bool, error) {
+			return []net.IP{net.ParseIP(targetIP)}, true, nil
+		}
+		resolver.lookupTLSA = func(ctx context.Context, service, proto, name string) ([]*dns.TLSA, bool, error) {
+			return newTLSA(3, 1, 1, targetSrv.Certificate()), secure, nil
+		}
+
+		get := func(store *x509.CertPool) error {
+			tr := &http.Transport{
+				Proxy:           http.ProxyURL(proxyURL),
+				TLSClientConfig: &tls.Config{RootCAs: store},
+			}
+			req, _ := http.NewRequest("GET", "https://example.com:"+targetPort, nil)
+			resp, err := tr.RoundTrip(req)
+			if err == nil {
+				resp.Body.Close()
+			}
+			return err
+		}
+
+		if err := get(daneStore); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := tun.pins.pinned("example.com", targetPort); !ok {
+			t.Fatal("host not pinned after dane tunnel")
+		}
+
+		// tlsa stripped
+		secure = false
+		if err := get(webPKIStore); err == nil {
+			t.Fatal("got nil, wanted an error for pinned host")
+		}
+
+		// pins take precedence over the bypass list
+		tun.bypass, _ = newHostPortSet([]string{"example.com"})
+		defer func() { tun.bypass = nil }()
+		if err := get(webPKIStore); err == nil {
+			t.Fatal("got nil, wanted an error for bypassed pinned host")
+		}
+	})
+
+	t.Run("error_page", func(t *testing.T) {
+		tun := proxyHandler.Tunneler.(*tunneler)
+		tun.nameChecks = true
+		tun.constraints = nil
+		tun.permitted = nil
+		tun.required = nil
+		tun.bypass = nil
+		tun.strictPKIX = false
+		tun.errorPages = true
+		defer func() { tun.errorPages = false }()
+
+		resolver.lookupIP = func(ctx context.Context, network, host string) ([]net.IP, bool, error) {
+			return []net.IP{net.ParseIP(targetIP)}, true, nil
+		}
+		resolver.lookupTLSA = func(ctx context.Context, service, proto, name string) ([]*dns.TLSA, bool, error) {
+			return newTLSA(3, 1, 1, "1599B2352EE910499C0DA1A104575935477C5765CCD10D81F43B50AC"), true, nil
+		}
+
+		tr := &http.Transport{
+			Proxy:           http.ProxyURL(proxyURL),
+			TLSClientConfig: &tls.Config{RootCAs: daneStore},
+		}
+		spki := sha256.Sum256(targetSrv.Certificate().RawSubjectPublicKeyInfo)
+
+		req, _ := http.NewRequest("GET", "https://example.com:"+targetPort, nil)
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Fatalf("status = %d, wanted %d", resp.StatusCode, http.StatusBadGateway)
+		}
+		if !strings.Contains(string(body), hex.EncodeToString(spki[:])) ||
+			!strings.Contains(string(body), "1599B2352EE910499C0DA1A104575935477C5765CCD10D81F43B50AC") {
+			t.Fatalf("body = %s, wanted spki fingerprint and tlsa records", body)
+		}
+
+		req, _ = http.NewRequest("GET", "https://example.com:"+targetPort, nil)
+		req.Header.Set("Accept", "application/json")
+		resp, err = tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var f validationFailure
+		if err := json.NewDecoder(resp.Body).Decode(&f); err != nil {
+			t.Fatal(err)
+		}
+		if f.Host != "example.com" || !f.TLSASecure || len(f.TLSA) != 1 || f.SPKISHA256 != hex.EncodeToString(spki[:]) {
+			t.Fatalf("got %+v", f)
+		}
+		if f.OverrideToken != "" {
+			t.Fatal("got override token with overrides disabled")
+		}
+
+		// proceed anyway
+		tun.overrides, _ = loadOverrideStore("", "http://127.0.0.1/override")
+		defer func() { tun.overrides = nil }()
+
+		req, _ = http.NewRequest("GET", "https://example.com:"+targetPort, nil)
+		req.Header.Set("Accept", "application/json")
+		resp, err = tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f = validationFailure{}
+		json.NewDecoder(resp.Body).Decode(&f)
+		resp.Body.Close()
+		if f.OverrideToken == "" || f.OverrideURL != "http://127.0.0.1/override" {
+			t.Fatalf("got %+v, wanted override token", f)
+		}
+
+		form := url.Values{
+			"host":  {f.Host},
+			"port":  {f.Port},
+			"cert":  {f.CertSHA256},
+			"hours": {"1"},
+			"token": {"bad"},
+		}
+		post := func(form url.Values) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("POST", "/override", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+			tun.overrides.ServeHTTP(rec, req)
+			return rec
+		}
+
+		if rec := post(form); rec.Code != http.StatusForbidden {
+			t.Fatalf("bad token: status = %d, wanted %d", rec.Code, http.StatusForbidden)
+		}
+		form.Set("token", f.OverrideToken)
+		form.Set("hours", "1000")
+		if rec := post(form); rec.Code != http.StatusBadRequest {
+			t.Fatalf("bad hours: status = %d, wanted %d", rec.Code, http.StatusBadRequest)
+		}
+		form.Set("hours", "1")
+		if rec := post(form); rec.Code != http.StatusSeeOther {
+			t.Fatalf("status = %d, wanted %d", rec.Code, http.StatusSeeOther)
+		}
+
+		req, _ = http.NewRequest("GET", "https://example.com:"+targetPort, nil)
+		resp, err = tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "foo" {
+			t.Fatalf("body = %s, wanted 'foo'", body)
+		}
+	})
+
+	t.Run("no_sni", func(t *testing.T) {
+		tun := proxyHandler.Tunneler.(*tunneler)
+		tun.nameChecks = true
+		tun.constraints = nil
+		tun.permitted = nil
+		tun.required = nil
+		tun.bypass = nil
+		tun.strictPKIX = false
+
+		resolver.lookupIP = func(ctx context.Context, network, host string) ([]net.IP, bool, error) {
+			return []net.IP{net.ParseIP(targetIP)}, true, nil
+		}
+		resolver.lookupTLSA = func(ctx context.Context, service, proto, name string) ([]*dns.TLSA, bool, error) {
+			return newTLSA(3, 1, 1, targetSrv.Certificate()), true, nil
+		}
+
+		conn, err := net.Dial("tcp", proxyURL.Host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		fmt.Fprintf(conn, "CONNECT example.com:%s HTTP/1.1\r\nHost: example.com:%s\r\n\r\n", targetPort, targetPort)
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, wanted %d", resp.StatusCode, http.StatusOK)
+		}
+
+		// an empty server name without verification sends no sni
+		client := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		if err := client.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+
+		certs := client.ConnectionState().PeerCertificates
+		intermediates := x509.NewCertPool()
+		for _, c := range certs[1:] {
+			intermediates.AddCert(c)
+		}
+		if _, err := certs[0].Verify(x509.VerifyOptions{
+			DNSName:       "example.com",
+			Roots:         daneStore,
+			Intermediates: intermediates,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
 	t.Run("alpn", func(t *testing.T) {
 		proxyHandler.Tunneler.(*tunneler).nameChecks = true
 		proxyHandler.Tunneler.(*tunneler).constraints = nil
+		proxyHandler.Tunneler.(*tunneler).permitted = nil
+		proxyHandler.Tunneler.(*tunneler).bypass = nil
+		proxyHandler.Tunneler.(*tunneler).strictPKIX = false
 
 		// client supports "my_proto_2" and "my_proto"
 		// server only supports "my_proto". letsdane should negotiate a mutually supported ALPN
@@ -428,6 +1089,96 @@ func TestHandlerTLS(t *testing.T) {
 	})
 }
 
+func TestListenTLS(t *testing.T) {
+	targetSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("foo"))
+	}))
+	defer targetSrv.Close()
+
+	proxyCA, proxyConfig := newProxyTestConfig(t)
+	proxyConfig.Resolver = &testResolver{}
+	proxyConfig.ListenNames = []string{"localhost", "proxy.example"}
+	proxyHandler, err := proxyConfig.NewHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer("", proxyHandler)
+	srv.TLSConfig = proxyConfig.listenTLSConfig(proxyHandler.Tunneler.(*tunneler).mitm)
+	go srv.ServeTLS(ln, "", "")
+	defer srv.Close()
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	roots := x509.NewCertPool()
+	roots.AddCert(proxyCA)
+
+	for _, proto := range []string{"h2", "http/1.1"} {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+			ServerName: "proxy.example",
+			RootCAs:    roots,
+			NextProtos: []string{proto},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := conn.ConnectionState().NegotiatedProtocol; got != proto {
+			t.Errorf("negotiated protocol = %s, wanted %s", got, proto)
+		}
+		conn.Close()
+	}
+
+	if _, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: "other.example", RootCAs: roots}); err == nil {
+		t.Fatal("unknown server name: got nil, want error")
+	}
+
+	// certificates for intercepted hosts don't replace the listener certificate
+	listenLeaf := func() *x509.Certificate {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: "proxy.example", RootCAs: roots})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0]
+	}
+	before := listenLeaf()
+	mitm := proxyHandler.Tunneler.(*tunneler).mitm
+	for _, tlsa := range [][]*dns.TLSA{nil, newTLSA(3, 1, 1, "00")} {
+		if _, err := mitm.cert("proxy.example", tlsa); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if after := listenLeaf(); !after.Equal(before) {
+		t.Error("listener certificate changed after issuing a certificate for the same host")
+	}
+
+	// connect through the https proxy to an ip literal target (passed through)
+	webPKIStore := x509.NewCertPool()
+	webPKIStore.AddCert(targetSrv.Certificate())
+	tr := &http.Transport{
+		Proxy:           http.ProxyURL(&url.URL{Scheme: "https", Host: "localhost:" + port}),
+		TLSClientConfig: &tls.Config{RootCAs: webPKIStore},
+
+		// used for the connection to the proxy
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return tls.Dial(network, ln.Addr().String(), &tls.Config{ServerName: "localhost", RootCAs: roots})
+		},
+	}
+
+	resp, err := tr.RoundTrip(httptest.NewRequest("GET", targetSrv.URL, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "foo" {
+		t.Fatalf("body = %s, wanted 'foo'", body)
+	}
+}
+
 func TestNameInConstraints(t *testing.T) {
 	var tests = []struct {
 		input  string
@@ -451,6 +1202,42 @@ func TestNameInConstraints(t *testing.T) {
 	}
 }
 
+var requiredTest, _ = newDomainSet([]string{"example.com", "*.3b"})
+
+var permittedTest = map[string]struct{}{
+	"3b":          {},
+	"example.org": {},
+}
+
+func TestNameInPermitted(t *testing.T) {
+	var tests = []struct {
+		input  string
+		result bool
+	}{
+		{"", false},
+		{"3b", true},
+		{"bar.3b.", true},
+		{"example.org", true},
+		{"WWW.Example.ORG.", true},
+		{"www.example.org", true},
+		{"org", false},
+		{"example.com", false},
+		{"3b.com", false},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("test #%d", i), func(t *testing.T) {
+			if inPermitted(permittedTest, test.input) != test.result {
+				t.Fatalf("input = `%s`: got %v, wanted %v", test.input, !test.result, test.result)
+			}
+		})
+	}
+
+	if !inPermitted(nil, "example.com") {
+		t.Fatal("nil zones: got false, wanted true")
+	}
+}
+
 type roundTripperTestFunc func(req *http.Request) (*http.Response, error)
 
 // RoundTrip implements the RoundTripper interface.
@@ -461,6 +1248,7 @@ func (rt roundTripperTestFunc) RoundTrip(r *http.Request) (*http.Response, error
 type testResolver struct {
 	lookupIP   func(ctx context.Context, network, host string) ([]net.IP, bool, error)
 	lookupTLSA func(ctx context.Context, service, proto, name string) ([]*dns.TLSA, bool, error)
+	lookupPTR  func(ctx context.Context, ip net.IP) ([]string, bool, error)
 }
 
 func (t testResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, bool, error) {
@@ -470,3 +1258,57 @@ func (t testResolver) LookupIP(ctx context.Context, network, host string) ([]net
 func (t testResolver) LookupTLSA(ctx context.Context, service, proto, name string) ([]*dns.TLSA, bool, error) {
 	return t.lookupTLSA(ctx, service, proto, name)
 }
+
+func (t testResolver) LookupPTR(ctx context.Context, ip net.IP) ([]string, bool, error) {
+	if t.lookupPTR == nil {
+		return nil, false, errors.New("no ptr record found")
+	}
+	return t.lookupPTR(ctx, ip)
+}
+
+func TestProxyProtocol(t *testing.T) {
+	_, proxyConfig := newProxyTestConfig(t)
+	proxyConfig.Resolver = &testResolver{}
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, clients, _ := net.ParseCIDR("192.0.2.0/24")
+	proxyConfig.ProxyProtocolNets = []*net.IPNet{loopback}
+	proxyConfig.AllowedNets = []*net.IPNet{clients}
+
+	proxyHandler, err := proxyConfig.NewHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := proxyConfig.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer("", proxyHandler)
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	// access control uses the client address from the header,
+	// allowed clients get a 400 for the non-proxy request
+	for _, test := range []struct {
+		header   string
+		wantCode int
+	}{
+		{"PROXY TCP4 192.0.2.1 127.0.0.1 56324 8080\r\n", http.StatusBadRequest},
+		{"PROXY TCP4 198.51.100.1 127.0.0.1 56324 8080\r\n", http.StatusForbidden},
+	} {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fmt.Fprintf(conn, "%sGET / HTTP/1.1\r\nHost: proxy.example\r\nConnection: close\r\n\r\n", test.header)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+
+		if resp.StatusCode != test.wantCode {
+			t.Fatalf("%q: got status %d, want %d", test.header, resp.StatusCode, test.wantCode)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package letsdane
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/buffrr/letsdane/proxy"
+)
+
+// UpstreamRoute sends connections to destinations matching
+// Domains (domain names or *.domain wildcards) through the parent
+// proxy at URL. A nil URL connects to these destinations directly.
+type UpstreamRoute struct {
+	Domains []string
+	URL     *url.URL
+}
+
+type upstreamRoute struct {
+	domains *domainSet
+	dialer  *proxy.Dialer
+}
+
+// upstreams selects the parent proxy used to reach a destination
+type upstreams struct {
+	routes []upstreamRoute
+	def    *proxy.Dialer
+}
+
+// newUpstreams creates the parent proxy routes dialing proxies with
+// forward. It returns nil if there's neither a default proxy nor any routes.
+func newUpstreams(def *url.URL, routes []*UpstreamRoute, forward func(ctx context.Context, network, addr string) (net.Conn, error)) (*upstreams, error) {
+	if def == nil && len(routes) == 0 {
+		return nil, nil
+	}
+
+	u := &upstreams{}
+	for _, r := range routes {
+		domains, err := newDomainSet(r.Domains)
+		if err != nil {
+			return nil, err
+		}
+
+		route := upstreamRoute{domains: domains}
+		if r.URL != nil {
+			if route.dialer, err = proxy.NewDialer(r.URL); err != nil {
+				return nil, err
+			}
+			route.dialer.Forward = forward
+		}
+		u.routes = append(u.routes, route)
+	}
+
+	if def != nil {
+		var err error
+		if u.def, err = proxy.NewDialer(def); err != nil {
+			return nil, err
+		}
+		u.def.Forward = forward
+	}
+
+	return u, nil
+}
+
+// dialer returns the parent proxy for host or nil to
+// connect directly. The first matching route wins.
+func (u *upstreams) dialer(host string) *proxy.Dialer {
+	if u == nil {
+		return nil
+	}
+
+	for _, r := range u.routes {
+		if r.domains.match(host) {
+			return r.dialer
+		}
+	}
+
+	return u.def
+}
+
+// routed checks if host is resolved by a parent proxy. Neither
+// its addresses nor TLSA records are looked up locally, which
+// would leak the name (e.g. .onion) to the local resolver.
+func (d *dialer) routed(host string) bool {
+	pd := d.upstreams.dialer(host)
+	return pd != nil && pd.ResolvesNames()
+}
+
+// dialUpstream connects to dst through its parent proxy if any.
+// Parent proxies that don't resolve names are given the addresses
+// of dst instead.
+func (d *dialer) dialUpstream(ctx context.Context, network string, dst *addrList) (net.Conn, bool, error) {
+	pd := d.upstreams.dialer(dst.Host)
+	if pd == nil {
+		return nil, false, nil
+	}
+	if pd.ResolvesNames() {
+		conn, err := pd.DialContext(ctx, network, net.JoinHostPort(dst.Host, dst.Port))
+		return conn, true, err
+	}
+
+	for _, ip := range dst.IPs {
+		conn, err := pd.DialContext(ctx, network, net.JoinHostPort(ip.String(), dst.Port))
+		if err == nil {
+			return conn, true, nil
+		}
+	}
+
+	return nil, true, fmt.Errorf("could not reach any of %v through %s", dst.IPs, pd)
+}